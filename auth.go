@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	userAuth  string
+	useNetrc  bool
+	netrcFile string
+
+	// Send Basic auth up front, or answer only a Digest challenge
+	basicAuth, digestOnly bool
+
+	netrcEntries []netrcEntry
+	netrcLoaded  bool
+)
+
+// netrcEntry is a machine, or the default when Machine is empty, in a
+// .netrc file.
+type netrcEntry struct {
+	Machine, Login, Password string
+}
+
+// authFor finds the credentials for a URL from -u, the URL itself, or the
+// .netrc file, in that order.  A -u without a password takes the password
+// for that login from the .netrc file.
+func authFor(u *url.URL) (login, password string, ok bool) {
+	if userAuth != "" {
+		parts := strings.SplitN(userAuth, ":", 2)
+		if len(parts) == 2 {
+			return parts[0], parts[1], true
+		}
+		if e := netrcLookup(u.Hostname(), parts[0]); e != nil {
+			return parts[0], e.Password, true
+		}
+		return parts[0], "", true
+	}
+	if u.User != nil {
+		password, _ = u.User.Password()
+		return u.User.Username(), password, true
+	}
+	if e := netrcLookup(u.Hostname(), ""); e != nil {
+		return e.Login, e.Password, true
+	}
+	return "", "", false
+}
+
+// netrcLookup finds the .netrc entry for a host, and login if one is given,
+// when --netrc or --netrc-file is set.
+func netrcLookup(host, login string) *netrcEntry {
+	if !useNetrc && netrcFile == "" {
+		return nil
+	}
+	if !netrcLoaded {
+		netrcLoaded = true
+		file := netrcFile
+		if file == "" {
+			file = defaultNetrc()
+		}
+		var err error
+		if netrcEntries, err = readNetrc(file); err != nil && (debug || netrcFile != "") {
+			fmt.Fprintf(os.Stderr, "Error reading netrc %q: %s\n", file, err)
+		}
+	}
+	for _, e := range netrcEntries {
+		if (e.Machine == "" || strings.EqualFold(e.Machine, host)) &&
+			(login == "" || e.Login == login) {
+			return &e
+		}
+	}
+	return nil
+}
+
+// defaultNetrc is $NETRC, or else the .netrc file in the home directory.
+func defaultNetrc() string {
+	if env := os.Getenv("NETRC"); env != "" {
+		return env
+	}
+	home, _ := os.UserHomeDir()
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc")
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// readNetrc parses the machine, default, login and password tokens of a
+// .netrc file, skipping over macro definitions.
+func readNetrc(file string) (entries []netrcEntry, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cur *netrcEntry
+	inMacro := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if inMacro {
+			// A macro runs until an empty line
+			inMacro = line != ""
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Fields(line)
+		for i := 0; i < len(tokens); i++ {
+			next := func() string {
+				if i+1 < len(tokens) {
+					i++
+					return tokens[i]
+				}
+				return ""
+			}
+			switch tokens[i] {
+			case "machine":
+				entries = append(entries, netrcEntry{Machine: next()})
+				cur = &entries[len(entries)-1]
+			case "default":
+				entries = append(entries, netrcEntry{})
+				cur = &entries[len(entries)-1]
+			case "login", "password", "account":
+				token := tokens[i]
+				val := next()
+				if cur == nil {
+					continue
+				}
+				if token == "login" {
+					cur.Login = val
+				} else if token == "password" {
+					cur.Password = val
+				}
+			case "macdef":
+				next()
+				inMacro = true
+				i = len(tokens)
+			}
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// authRetry answers the challenge in a 401 response by making the request
+// again with the credentials for the URL.  Digest is used when offered, and
+// Basic only when it is the one offered, so a password is never sent in the
+// clear to a server wanting Digest.  The original response is returned when
+// there is no challenge it can answer.  The retry goes to the URL asked for,
+// so a challenge from a host redirected to is left unanswered rather than
+// giving that host's credentials to another.
+func authRetry(client *http.Client, resp *http.Response, u *url.URL, newReq func() *http.Request) (*http.Response, error) {
+	if resp.Request.URL.Host != u.Host {
+		if debug {
+			fmt.Println("Not answering challenge from redirect to", resp.Request.URL.Host)
+		}
+		return resp, nil
+	}
+	login, password, ok := authFor(u)
+	if !ok {
+		return resp, nil
+	}
+	var challenge map[string]string
+	basicOffered := false
+	for _, h := range resp.Header.Values("Www-Authenticate") {
+		if len(h) > 7 && strings.EqualFold(h[:7], "digest ") {
+			challenge = parseAuthParams(h[7:])
+			break
+		}
+		if len(h) >= 5 && strings.EqualFold(h[:5], "basic") {
+			basicOffered = true
+		}
+	}
+
+	req := newReq()
+	if challenge != nil {
+		auth, err := digestAuth(challenge, req, login, password)
+		if err != nil {
+			if debug {
+				fmt.Println("Cannot answer digest challenge:", err)
+			}
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return resp, nil
+		}
+		if debug {
+			fmt.Println("Answering digest challenge for", login)
+		}
+		req.Header.Set("Authorization", auth)
+	} else if basicOffered && !basicAuth && !digestOnly {
+		if debug {
+			fmt.Println("Answering basic challenge for", login)
+		}
+		req.SetBasicAuth(login, password)
+	} else {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return client.Do(req)
+}
+
+// digestAuth makes the Authorization header answering a Digest challenge,
+// as set out in RFC 7616, for the MD5 and SHA-256 algorithms with qop=auth.
+func digestAuth(c map[string]string, req *http.Request, login, password string) (string, error) {
+	algorithm := c["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	h := func(s string) string {
+		hh := newHash()
+		io.WriteString(hh, s)
+		return fmt.Sprintf("%x", hh.Sum(nil))
+	}
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce, nc := fmt.Sprintf("%x", cnonceBytes), "00000001"
+	realm, nonce, uri := c["realm"], c["nonce"], req.URL.RequestURI()
+
+	ha1 := h(login + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	qop := ""
+	if c["qop"] != "" {
+		for _, q := range strings.Split(c["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported qop %q", c["qop"])
+		}
+	}
+
+	var response string
+	if qop != "" {
+		response = h(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, response="%s"`,
+		quoteEscaper.Replace(login), quoteEscaper.Replace(realm), quoteEscaper.Replace(nonce),
+		quoteEscaper.Replace(uri), algorithm, response)
+	if opaque, ok := c["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, quoteEscaper.Replace(opaque))
+	}
+	if qop != "" {
+		auth += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	return auth, nil
+}
+
+// parseAuthParams splits the comma separated name=value pairs of a
+// challenge, where values may be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++
+			}
+			val, s = b.String(), s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[name] = val
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	awsSigV4 string
+	awsCreds *awsCredentials
+)
+
+// awsCredentials are the keys requests are signed with.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsSigner holds what --aws-sigv4 gives, in the curl form
+// provider1[:provider2[:region[:service]]], or provider:region:service.
+type awsSigner struct {
+	Provider1, Provider2, Region, Service string
+}
+
+// parseSigV4 reads the --aws-sigv4 value, taking the region and service from
+// an AWS style host name when they are left off.
+func parseSigV4(arg, host string) (*awsSigner, error) {
+	parts := strings.Split(arg, ":")
+	s := &awsSigner{Provider1: parts[0]}
+	switch len(parts) {
+	case 3:
+		s.Region, s.Service = parts[1], parts[2]
+	case 4:
+		s.Provider2, s.Region, s.Service = parts[1], parts[2], parts[3]
+	default:
+		if len(parts) == 2 {
+			s.Provider2 = parts[1]
+		}
+		// Such as s3.us-west-2.amazonaws.com or sqs.us-east-1.amazonaws.com
+		labels := strings.Split(strings.Split(host, ":")[0], ".")
+		if len(labels) < 4 {
+			return nil, fmt.Errorf("Cannot tell the region and service from %q, use --aws-sigv4 provider:region:service", host)
+		}
+		s.Service, s.Region = labels[len(labels)-4], labels[len(labels)-3]
+	}
+	if s.Provider1 == "" || s.Region == "" || s.Service == "" {
+		return nil, fmt.Errorf("Invalid --aws-sigv4 %q", arg)
+	}
+	if s.Provider2 == "" {
+		s.Provider2 = s.Provider1
+		if strings.EqualFold(s.Provider1, "aws") {
+			s.Provider2 = "amz"
+		}
+	}
+	return s, nil
+}
+
+// signSigV4 adds the Signature Version 4 headers to a request, with the
+// payload hash taken from the request body as sent.
+func signSigV4(req *http.Request, payload []byte) error {
+	s, err := parseSigV4(awsSigV4, req.URL.Host)
+	if err != nil {
+		return err
+	}
+	if awsCreds == nil {
+		if awsCreds, err = loadAWSCredentials(); err != nil {
+			return err
+		}
+	}
+
+	payloadSum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(payloadSum[:])
+
+	algorithm := strings.ToUpper(s.Provider1) + "4-HMAC-SHA256"
+	p2 := strings.ToLower(s.Provider2)
+	prefix := "X-" + strings.ToUpper(p2[:1]) + p2[1:] + "-"
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set(prefix+"Date", amzDate)
+	req.Header.Set(prefix+"Content-Sha256", payloadHash)
+	if awsCreds.SessionToken != "" {
+		req.Header.Set(prefix+"Security-Token", awsCreds.SessionToken)
+	}
+
+	// Sign the host, the content type and the provider's own headers
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, vals := range req.Header {
+		lname := strings.ToLower(name)
+		if lname == "content-type" || strings.HasPrefix(lname, strings.ToLower(prefix)) {
+			trimmed := make([]string, len(vals))
+			for i, v := range vals {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			headers[lname] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		sigV4Path(req.URL.EscapedPath(), s.Service),
+		sigV4Query(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	if debug {
+		log.Printf("SigV4 canonical request:\n%s", canonical)
+	}
+
+	suffix := strings.ToLower(s.Provider1) + "4_request"
+	scope := strings.Join([]string{date, s.Region, s.Service, suffix}, "/")
+	canonSum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{algorithm, amzDate, scope, hex.EncodeToString(canonSum[:])}, "\n")
+
+	key := []byte(strings.ToUpper(s.Provider1) + "4" + awsCreds.SecretAccessKey)
+	for _, part := range []string{date, s.Region, s.Service, suffix} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, awsCreds.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// sigV4Escape encodes everything but the unreserved characters, as SigV4
+// expects.
+func sigV4Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sigV4Path is the canonical path, where each segment is encoded once for S3
+// and twice for every other service.
+func sigV4Path(escaped, service string) string {
+	if escaped == "" {
+		return "/"
+	}
+	segments := strings.Split(escaped, "/")
+	for i, seg := range segments {
+		if service == "s3" {
+			if raw, err := url.PathUnescape(seg); err == nil {
+				seg = raw
+			}
+		}
+		segments[i] = sigV4Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sigV4Query is the canonical query string, sorted by name then value.
+func sigV4Query(q url.Values) string {
+	var pairs [][2]string
+	for name, vals := range q {
+		for _, v := range vals {
+			pairs = append(pairs, [2]string{sigV4Escape(name), sigV4Escape(v)})
+		}
+	}
+	// Sorted on the encoded name then value, not the joined pair, as a=
+	// would otherwise come after a1=
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	joined := make([]string, len(pairs))
+	for i, p := range pairs {
+		joined[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(joined, "&")
+}
+
+// loadAWSCredentials finds the keys to sign with in -u, the environment, the
+// shared credentials file or else the instance metadata service.
+func loadAWSCredentials() (*awsCredentials, error) {
+	if userAuth != "" {
+		parts := strings.SplitN(userAuth, ":", 2)
+		if len(parts) == 2 {
+			return &awsCredentials{AccessKeyID: parts[0], SecretAccessKey: parts[1]}, nil
+		}
+	}
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if c, err := sharedAWSCredentials(); err == nil {
+		return c, nil
+	} else if debug {
+		log.Println("No shared AWS credentials:", err)
+	}
+	c, err := imdsCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("No AWS credentials found in the environment, shared credentials file or instance metadata: %s", err)
+	}
+	return c, nil
+}
+
+// sharedAWSCredentials reads the profile named by $AWS_PROFILE, or default,
+// from the shared credentials file.
+func sharedAWSCredentials() (*awsCredentials, error) {
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			section = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if section != profile || len(kv) < 2 {
+			continue
+		}
+		val := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "aws_access_key_id":
+			c.AccessKeyID = val
+		case "aws_secret_access_key":
+			c.SecretAccessKey = val
+		case "aws_session_token":
+			c.SessionToken = val
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("No keys for profile %q in %q", profile, file)
+	}
+	return &c, nil
+}
+
+// imdsCredentials gets the instance role's keys from the metadata service,
+// using an IMDSv2 session token.
+func imdsCredentials() (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	client := &http.Client{Timeout: timeout}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	do := func(method, path string, header http.Header) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		byt, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+		}
+		return byt, err
+	}
+
+	token, err := do("PUT", "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"300"}})
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	roles, err := do("GET", "/latest/meta-data/iam/security-credentials/", header)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, errors.New("No instance role")
+	}
+	byt, err := do("GET", "/latest/meta-data/iam/security-credentials/"+role, header)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+	}
+	if err = json.Unmarshal(byt, &resp); err != nil {
+		return nil, err
+	}
+	return &awsCredentials{AccessKeyID: resp.AccessKeyID, SecretAccessKey: resp.SecretAccessKey, SessionToken: resp.Token}, nil
+}
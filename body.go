@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var (
+	bodyJQ    string
+	bodyItems []string
+)
+
+// A body item is a field name followed by = for a string or := for raw JSON,
+// while a URL always has a : or / before any =.
+var bodyItemRE = regexp.MustCompile(`(?s)^([A-Za-z0-9_.\-]+)(:=|=)(.*)$`)
+
+// splitBodyItems takes the httpie style body items, such as name=foo and
+// count:=3, out of the arguments and returns the URLs left.
+func splitBodyItems(args []string) (rest []string) {
+	for _, arg := range args {
+		if bodyItemRE.MatchString(arg) {
+			bodyItems = append(bodyItems, arg)
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return
+}
+
+// buildBody makes the JSON request body from the body items and --body-jq.
+// The items build an object, which is given to --body-jq as its input.
+func buildBody() error {
+	if len(bodyItems) == 0 && bodyJQ == "" {
+		return nil
+	}
+	if dataSet || len(formFields) > 0 {
+		return errors.New("Cannot combine body items or --body-jq with --data or --form")
+	}
+
+	var body interface{}
+	if len(bodyItems) > 0 {
+		obj := make(map[string]interface{})
+		for _, item := range bodyItems {
+			m := bodyItemRE.FindStringSubmatch(item)
+			name, op, val := m[1], m[2], m[3]
+			// As with httpie, name=@file and name:=@file read the value from a file
+			if strings.HasPrefix(val, "@") {
+				byt, err := ioutil.ReadFile(val[1:])
+				if err != nil {
+					return err
+				}
+				val = string(byt)
+			}
+			if op == "=" {
+				obj[name] = val
+				continue
+			}
+			var v interface{}
+			if err := json.Unmarshal([]byte(val), &v); err != nil {
+				return fmt.Errorf("Invalid JSON for %q: %s", name, err)
+			}
+			obj[name] = v
+		}
+		body = obj
+	}
+
+	if bodyJQ != "" {
+		query, err := compileJQ(bodyJQ)
+		if err != nil {
+			return fmt.Errorf("Error compiling body jq query %q: %s", bodyJQ, err)
+		}
+		v, ok := query.Run(body).Next()
+		if !ok {
+			return fmt.Errorf("Body jq query %q gave no value", bodyJQ)
+		}
+		if err, ok := v.(error); ok {
+			return fmt.Errorf("Error running body jq query %q: %s", bodyJQ, err)
+		}
+		body = v
+	}
+
+	byt, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	postData, postDataRaw, dataSet = string(byt), true, true
+	return nil
+}
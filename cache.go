@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheMeta is the sidecar record stored next to each cached body, used to
+// decide when the entry expires and how to revalidate it with the server.
+type cacheMeta struct {
+	URL          string      `json:"url"`
+	Method       string      `json:"method"`
+	Key          string      `json:"key,omitempty"`
+	Status       int         `json:"status"`
+	StatusLine   string      `json:"status_line,omitempty"`
+	Proto        string      `json:"proto,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Size         int         `json:"size"`
+	Encrypted    bool        `json:"encrypted,omitempty"`
+	Encoding     string      `json:"encoding,omitempty"`
+	Sum          string      `json:"sha256,omitempty"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Fetched      time.Time   `json:"fetched"`
+	Expires      time.Time   `json:"expires"`
+	Accessed     time.Time   `json:"accessed"`
+	MAC          string      `json:"mac,omitempty"`
+
+	// The cache file name before any Vary headers, which names the .lock
+	// and .vary files of the entry
+	Base string `json:"base,omitempty"`
+}
+
+// newCacheMeta starts the sidecar record for a request to a URL.
+func newCacheMeta(u *url.URL) *cacheMeta {
+	return &cacheMeta{URL: u.String(), Method: method, Key: cacheKeyName, Base: filepath.Base(cacheBase(u))}
+}
+
+// Fresh reports if the entry can be used without contacting the server.
+func (m *cacheMeta) Fresh() bool {
+	return time.Now().Before(m.Expires)
+}
+
+// CanRevalidate reports if the server gave us a validator to send back.
+func (m *cacheMeta) CanRevalidate() bool {
+	return m.ETag != "" || m.LastModified != ""
+}
+
+// SetValidators adds the conditional request headers for a stale entry.
+func (m *cacheMeta) SetValidators(req *http.Request) {
+	if m.ETag != "" {
+		req.Header.Set("If-None-Match", m.ETag)
+	}
+	if m.LastModified != "" {
+		req.Header.Set("If-Modified-Since", m.LastModified)
+	}
+}
+
+// Update records the validators and expiry from a server response.  The
+// returned bool is false when the server asked for the response not to be
+// stored.
+func (m *cacheMeta) Update(resp *http.Response) bool {
+	now := time.Now()
+	m.Fetched = now
+	if resp.StatusCode != http.StatusNotModified {
+		m.Status = resp.StatusCode
+		m.StatusLine = resp.Status
+		m.Proto = resp.Proto
+		m.Header = resp.Header.Clone()
+	} else {
+		// A 304 carries updated headers for the stored response
+		if m.Header == nil {
+			m.Header = make(http.Header)
+		}
+		for key, vals := range resp.Header {
+			m.Header[key] = vals
+		}
+		if resp.Header.Get("Age") == "" {
+			// The stored age was of the response before it was revalidated
+			m.Header.Del("Age")
+		}
+	}
+	// Freshness comes from the stored headers, as a bare 304 may not repeat
+	// the Cache-Control of the response it revalidates
+	h := m.Header
+	if etag := h.Get("ETag"); etag != "" {
+		m.ETag = etag
+	}
+	if lm := h.Get("Last-Modified"); lm != "" {
+		m.LastModified = lm
+	}
+
+	// Cache-Control takes precedence over Expires, which takes precedence over
+	// the --max-age default.
+	m.Expires = now.Add(maxAge)
+	cc := parseCacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		m.Expires = now
+	} else if v, ok := cc["max-age"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil {
+			if age, err := strconv.Atoi(h.Get("Age")); err == nil {
+				secs -= age
+			}
+			m.Expires = now.Add(time.Duration(secs) * time.Second)
+		}
+	} else if v := h.Get("Expires"); v != "" {
+		if exp, err := http.ParseTime(v); err != nil {
+			// Invalid dates, such as "0", mean already expired
+			m.Expires = now
+		} else if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			// Use the server's own clock to avoid skew
+			m.Expires = now.Add(exp.Sub(date))
+		} else {
+			m.Expires = exp
+		}
+	}
+	return true
+}
+
+// SetMaxAgeFromJQ overrides the expiry with the number of seconds (or a
+// duration string) produced by the --max-age-jq query over the body.
+func (m *cacheMeta) SetMaxAgeFromJQ(body interface{}) {
+	query, err := compileJQ(maxAgeJQ)
+	if err != nil {
+		log.Fatalf("Error compiling max-age jq query %q: %s", maxAgeJQ, err)
+	}
+	v, ok := query.Run(body).Next()
+	if !ok {
+		return
+	}
+	var age time.Duration
+	switch t := v.(type) {
+	case int:
+		age = time.Duration(t) * time.Second
+	case float64:
+		age = time.Duration(t * float64(time.Second))
+	case string:
+		if age, err = time.ParseDuration(t); err != nil {
+			if debug {
+				log.Printf("Ignoring max-age-jq result %q: %s", t, err)
+			}
+			return
+		}
+	default:
+		if debug {
+			log.Printf("Ignoring max-age-jq result %#v", v)
+		}
+		return
+	}
+	m.Expires = m.Fetched.Add(age)
+}
+
+// parseCacheControl splits the Cache-Control header into lower case
+// directives and their (unquoted) values.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if kv[0] == "" {
+				continue
+			}
+			var val string
+			if len(kv) == 2 {
+				val = strings.Trim(kv[1], `"`)
+			}
+			cc[strings.ToLower(kv[0])] = val
+		}
+	}
+	return cc
+}
+
+func metaFile(cacheFile string) string { return cacheFile + ".meta" }
+
+// cacheBase is the cache file name for a request before any Vary headers are
+// taken into account.  It covers the method, the request body and either the
+// normalized URL or the --cache-key name, so mirrors can share an entry.
+func cacheBase(u *url.URL) string {
+	name := normalizeURL(u)
+	if cacheKeyName != "" {
+		name = "key:" + cacheKeyName
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n", method, name)
+	// Keep apart what different users are allowed to see
+	if login, _, ok := authFor(u); ok {
+		fmt.Fprintf(h, "user:%s\n", login)
+	}
+	if oauthTokenURL != "" {
+		fmt.Fprintf(h, "oauth2:%s\n", oauthIdentity())
+	}
+	if awsSigV4 != "" {
+		if awsCreds == nil {
+			awsCreds, _ = loadAWSCredentials()
+		}
+		if awsCreds != nil {
+			fmt.Fprintf(h, "aws:%s\n", awsCreds.AccessKeyID)
+		}
+	}
+	hashBody(h)
+	return fmt.Sprintf("%s/jqurl_%x", cacheDir, h.Sum(nil))
+}
+
+// hashBody adds the request body to a cache key.  Files are keyed on their
+// path, size and modification time rather than read, so a large upload is
+// not read again for every key.
+func hashBody(h io.Writer) {
+	statFile := func(file string) {
+		if st, err := os.Stat(file); err == nil {
+			fmt.Fprintf(h, "file:%q %d %d\n", file, st.Size(), st.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(h, "file:%q\n", file)
+		}
+	}
+	for _, f := range formFields {
+		fmt.Fprintf(h, "form:%q %q %q %q %v\n", f.Name, f.Value, f.ContentType, f.Filename, f.Upload)
+		if f.File != "" {
+			statFile(f.File)
+		}
+	}
+	if !dataSet {
+		return
+	}
+	if !postDataRaw && strings.HasPrefix(postData, "@") {
+		statFile(postData[1:])
+		return
+	}
+	io.WriteString(h, postData)
+}
+
+// cacheFile is the cache file name for a request.  When a previous response
+// listed Vary headers, the values of those request headers are added to the
+// key so each variant gets its own entry.
+func cacheFile(u *url.URL) string {
+	base := cacheBase(u)
+	byt, err := readCacheFile(base + ".vary")
+	if err != nil {
+		return base
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n", filepath.Base(base))
+	header := requestHeader(u).Header
+	for _, name := range strings.Fields(string(byt)) {
+		fmt.Fprintf(h, "%s: %s\n", name, strings.Join(header.Values(name), ", "))
+	}
+	return fmt.Sprintf("%s/jqurl_%x", cacheDir, h.Sum(nil))
+}
+
+// setVary records the Vary headers of a response for the request's cache
+// entry.  The returned bool is false when the response can't be cached as it
+// varies on everything.
+func setVary(u *url.URL, resp *http.Response) bool {
+	var names []string
+	for _, line := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "*" {
+				return false
+			}
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	varyFile := cacheBase(u) + ".vary"
+	if len(names) == 0 {
+		os.Remove(varyFile)
+		return true
+	}
+	sort.Strings(names)
+	err := writeFileAtomic(varyFile, []byte(strings.Join(names, "\n")))
+	if err != nil && debug {
+		log.Println("Error writing vary file:", err)
+	}
+	return true
+}
+
+// lockCache takes an exclusive lock on the cache entry for a URL, waiting for
+// any other jqurl fetching the same entry to finish first.  The returned
+// function releases the lock.
+func lockCache(u *url.URL) func() {
+	return lockFile(cacheBase(u) + ".lock")
+}
+
+// lockFile waits for an exclusive lock on a file in the cache directory,
+// returning the function to release it.
+func lockFile(file string) func() {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		if debug {
+			log.Println("Unable to open lock file", file, err)
+		}
+		return func() {}
+	}
+	if debug {
+		log.Println("waiting on lock", file)
+	}
+	if err = lockFileWait(f); err != nil && debug {
+		log.Println("Unable to lock", file, err)
+	}
+	return func() { f.Close() }
+}
+
+// readCacheFile reads a file from the cache directory, after checking it is
+// a regular file which only the current user could have written.
+func readCacheFile(file string) ([]byte, error) {
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("Cache file %q is not a regular file", file)
+	}
+	if err = checkPrivate(file, fi); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file)
+}
+
+// privateCacheDir returns the per user directory within the --cachedir,
+// creating it if needed, so other users can't plant or read entries.
+func privateCacheDir(dir string) (string, error) {
+	dir = filepath.Join(dir, "jqurl-"+userID())
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("Cache directory %q is not a directory", dir)
+	}
+	if err = checkPrivate(dir, fi); err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm() != 0700 {
+		// Keep other users from reading what we cached
+		if err = os.Chmod(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and then
+// renames it into place, so a concurrent reader never sees a partial file.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// normalizeURL returns the URL with the scheme and host lower cased, the
+// default port and fragment removed, and the query parameters sorted.
+func normalizeURL(u *url.URL) string {
+	n := *u
+	n.Scheme = strings.ToLower(n.Scheme)
+	host := strings.ToLower(n.Host)
+	if n.Scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	} else if n.Scheme == "https" {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	n.Host = host
+	if n.Path == "" {
+		n.Path = "/"
+	}
+	n.RawQuery = n.Query().Encode()
+	n.Fragment = ""
+	n.RawFragment = ""
+	return n.String()
+}
+
+// loadCache reads the entry for the i-th URL into dat when it is still fresh,
+// or of any age when anyAge is set.  A stale entry is kept in cacheMetas so it
+// can be revalidated.
+func loadCache(i int, anyAge bool) bool {
+	cacheFiles[i] = cacheFile(urls[i])
+	meta, err := readCacheMeta(cacheFiles[i])
+	if err != nil {
+		if debug {
+			log.Println("no cache metadata", err)
+		}
+		return false
+	}
+	cacheMetas[i] = meta
+	if !meta.Fresh() && !anyAge {
+		if debug {
+			log.Println("stale cache", cacheFiles[i], "expired", meta.Expires)
+		}
+		return false
+	}
+	if debug {
+		log.Println("found cache", cacheFiles[i])
+	}
+	// With a stored result for the query, there is no need to parse the body
+	if !loadResult(cacheFiles[i], meta) {
+		byt, err := readCacheBody(cacheFiles[i], meta)
+		if err == nil {
+			err = json.Unmarshal(byt, &dat)
+		}
+		if err != nil {
+			if debug {
+				log.Println("Cannot use cache", cacheFiles[i], err)
+			}
+			return false
+		}
+	}
+	if debug {
+		log.Println("using cache", cacheFiles[i])
+	}
+	// Note the use for least recently used eviction
+	meta.Accessed = time.Now()
+	if err = writeCacheMeta(cacheFiles[i], meta); err != nil && debug {
+		log.Println("Error updating cache metadata", err)
+	}
+	if includeHeader {
+		if meta.Fresh() {
+			meta.PrintHeader("HIT")
+		} else {
+			meta.PrintHeader("STALE")
+		}
+	}
+	return true
+}
+
+// PrintHeader replays the stored status line and headers of the entry to
+// stderr, noting where the data came from and how old it is.
+func (m *cacheMeta) PrintHeader(xCache string) {
+	h := m.Header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("X-Cache", xCache)
+	h.Set("Age", strconv.Itoa(int(time.Since(m.Fetched).Seconds())))
+	printHeader(m.Proto, m.StatusLine, h)
+}
+
+// loadStaleCache reads the most recently expired entry among the URLs into
+// dat, provided it expired within the --stale-if-error window.  A warning is
+// printed when one is used.
+func loadStaleCache() bool {
+	var best *cacheMeta
+	var bestFile string
+	for _, f := range cacheFiles {
+		meta, err := readCacheMeta(f)
+		if err != nil || meta.Fresh() || time.Since(meta.Expires) > staleIfError {
+			// Only expired entries are stale, a fresh one was used already if it could be
+			continue
+		}
+		if best == nil || meta.Expires.After(best.Expires) {
+			best, bestFile = meta, f
+		}
+	}
+	if best == nil {
+		return false
+	}
+	byt, err := readCacheBody(bestFile, best)
+	if err == nil {
+		err = json.Unmarshal(byt, &dat)
+	}
+	if err != nil {
+		if debug {
+			log.Println("Cannot use stale cache", bestFile, err)
+		}
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Warning: every URL failed, using stale cache of %s expired %s ago\n",
+		best.URL, time.Since(best.Expires).Round(time.Second))
+	if includeHeader {
+		best.PrintHeader("STALE")
+	}
+	return true
+}
+
+// readCacheMeta loads the sidecar record for a cache file.
+func readCacheMeta(cacheFile string) (*cacheMeta, error) {
+	byt, err := readCacheFile(metaFile(cacheFile))
+	if err != nil {
+		return nil, err
+	}
+	var m cacheMeta
+	if err = json.Unmarshal(byt, &m); err != nil {
+		return nil, fmt.Errorf("Invalid cache metadata %q: %s", metaFile(cacheFile), err)
+	}
+	if cacheHMAC {
+		if err = verifyMeta(cacheFile, &m); err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// writeCacheMeta stores the sidecar record for a cache file.
+func writeCacheMeta(cacheFile string, m *cacheMeta) error {
+	m.MAC = ""
+	if cacheHMAC {
+		var err error
+		if m.MAC, err = signMeta(cacheFile, m); err != nil {
+			return err
+		}
+	}
+	byt, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metaFile(cacheFile), byt)
+}
+
+// readCacheBody reads a cached body, decrypting and decompressing it when
+// needed.
+func readCacheBody(cacheFile string, m *cacheMeta) ([]byte, error) {
+	if encryptCache && !m.Encrypted {
+		return nil, fmt.Errorf("Cache file %q is not encrypted", cacheFile)
+	}
+	byt, err := readCacheFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(byt); m.Sum != "" && m.Sum != hex.EncodeToString(sum[:]) ||
+		cacheHMAC && m.Sum == "" {
+		return nil, fmt.Errorf("Cache file %q does not match its checksum", cacheFile)
+	}
+	if m.Encrypted {
+		if byt, err = decryptBody(cacheFile, byt); err != nil {
+			return nil, err
+		}
+	}
+	switch m.Encoding {
+	case "":
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(byt))
+		if err != nil {
+			return nil, fmt.Errorf("Cache file %q failed decompression: %s", cacheFile, err)
+		}
+		defer zr.Close()
+		if byt, err = ioutil.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("Cache file %q failed decompression: %s", cacheFile, err)
+		}
+	default:
+		return nil, fmt.Errorf("Cache file %q has unknown encoding %q", cacheFile, m.Encoding)
+	}
+	return byt, nil
+}
+
+// writeCache stores a response body along with its sidecar record, then
+// evicts the least recently used entries when over the cache limits.
+func writeCache(cacheFile string, body []byte, m *cacheMeta) error {
+	m.Size = len(body)
+	m.Accessed = time.Now()
+	m.Encoding = ""
+	if compressCache {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body, m.Encoding = buf.Bytes(), "gzip"
+	}
+	m.Encrypted = encryptCache
+	if encryptCache {
+		var err error
+		if body, err = encryptBody(cacheFile, body); err != nil {
+			return err
+		}
+	}
+	sum := sha256.Sum256(body)
+	m.Sum = hex.EncodeToString(sum[:])
+	rotateHistory(cacheFile)
+	removeResults(cacheFile)
+	if err := writeFileAtomic(cacheFile, body); err != nil {
+		return err
+	}
+	if err := writeCacheMeta(cacheFile, m); err != nil {
+		return err
+	}
+	evictCache(cacheFile)
+	return nil
+}
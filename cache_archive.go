@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Names of the files which may be restored from a cache archive
+var archiveName = regexp.MustCompile(`^jqurl_[0-9a-f]+(\.meta|\.vary)?$`)
+
+// exportCache packs the body and metadata of cache entries, along with the
+// Vary lists needed to find them, into a tar archive.  A file name ending in
+// .gz or .tgz is gzip compressed, and "-" writes to stdout.
+func exportCache(file string, records []cacheRecord) (err error) {
+	var out io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = f
+	}
+	if strings.HasSuffix(file, ".gz") || strings.HasSuffix(file, ".tgz") {
+		zw := gzip.NewWriter(out)
+		defer func() {
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = zw
+	}
+	tw := tar.NewWriter(out)
+
+	var files []string
+	for _, rec := range records {
+		files = append(files, rec.File, metaFile(rec.File))
+	}
+	varyFiles, _ := filepath.Glob(filepath.Join(cacheDir, "jqurl_*.vary"))
+	files = append(files, varyFiles...)
+
+	for _, f := range files {
+		if err = addToArchive(tw, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addToArchive writes one cache file into the tar archive.
+func addToArchive(tw *tar.Writer, file string) error {
+	byt, err := readCacheFile(file)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    filepath.Base(file),
+		Mode:    0600,
+		Size:    int64(len(byt)),
+		ModTime: fi.ModTime(),
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(byt)
+	return err
+}
+
+// importCache restores the entries in a tar archive made by exportCache into
+// the cache directory, returning the entries restored.  A file name ending in
+// .gz or .tgz is gzip decompressed, and "-" reads from stdin.
+func importCache(file string) ([]cacheRecord, error) {
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	if strings.HasSuffix(file, ".gz") || strings.HasSuffix(file, ".tgz") {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		in = zr
+	}
+	tr := tar.NewReader(in)
+
+	var records []cacheRecord
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return records, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !archiveName.MatchString(hdr.Name) {
+			return records, fmt.Errorf("Unexpected file %q in cache archive", hdr.Name)
+		}
+		byt, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return records, err
+		}
+		dest := filepath.Join(cacheDir, hdr.Name)
+		if err = writeFileAtomic(dest, byt); err != nil {
+			return records, err
+		}
+		os.Chtimes(dest, hdr.ModTime, hdr.ModTime)
+		if strings.HasSuffix(dest, ".meta") {
+			cacheFile := strings.TrimSuffix(dest, ".meta")
+			if meta, err := readCacheMeta(cacheFile); err == nil {
+				records = append(records, cacheRecord{File: cacheFile, cacheMeta: meta})
+			}
+		}
+	}
+	return records, nil
+}
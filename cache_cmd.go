@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pschou/go-params"
+)
+
+// cacheRecord is a cache entry as reported by the cache subcommands.
+type cacheRecord struct {
+	File string `json:"file"`
+	*cacheMeta
+}
+
+// cacheCommand handles the "cache" subcommand family for inspecting, cleaning
+// up and moving around the cache directory.
+func cacheCommand(args []string) {
+	if len(args) == 0 {
+		params.Usage()
+		os.Exit(1)
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		printRecords(cacheRecords())
+	case "show", "rm":
+		if len(args) == 0 {
+			log.Fatalf("Missing URL for cache %s", cmd)
+		}
+		found := matchRecords(args)
+		if cmd == "rm" {
+			removeRecords(found)
+		}
+		printRecords(found)
+	case "prune":
+		var olderThan time.Duration
+		fs := params.NewFlagSet("prune", params.ExitOnError)
+		fs.DurationVar(&olderThan, "older-than", 0, "Remove entries fetched longer ago than this, instead of the expired ones", "DURATION")
+		fs.Parse(args)
+		var found []cacheRecord
+		for _, rec := range cacheRecords() {
+			if olderThan > 0 && time.Since(rec.Fetched) > olderThan ||
+				olderThan == 0 && !rec.Fresh() {
+				found = append(found, rec)
+			}
+		}
+		removeRecords(found)
+		removeOrphans()
+		printRecords(found)
+	case "purge":
+		found := cacheRecords()
+		removeRecords(found)
+		// Also clear out the vary lists and any entries without metadata
+		files, _ := filepath.Glob(filepath.Join(cacheDir, "jqurl_*"))
+		for _, f := range files {
+			if err := os.Remove(f); err != nil && debug {
+				log.Println("Error removing", f, err)
+			}
+		}
+		printRecords(found)
+	case "export":
+		if len(args) == 0 {
+			log.Fatalf("Missing archive file for cache export")
+		}
+		found := cacheRecords()
+		if len(args) > 1 {
+			found = matchRecords(args[1:])
+		}
+		if err := exportCache(args[0], found); err != nil {
+			log.Fatalf("Error exporting cache to %q: %s", args[0], err)
+		}
+		if args[0] != "-" {
+			printRecords(found)
+		}
+	case "import":
+		if len(args) == 0 {
+			log.Fatalf("Missing archive file for cache import")
+		}
+		found, err := importCache(args[0])
+		if err != nil {
+			log.Fatalf("Error importing cache from %q: %s", args[0], err)
+		}
+		printRecords(found)
+	default:
+		log.Fatalf("Unknown cache command %q", cmd)
+	}
+}
+
+// Matches reports if the entry was made for a URL, or under a cache key name.
+func (r cacheRecord) Matches(arg string) bool {
+	if r.Key != "" && r.Key == arg {
+		return true
+	}
+	u, err := url.Parse(arg)
+	if err != nil {
+		return false
+	}
+	ru, err := url.Parse(r.URL)
+	if err != nil {
+		return false
+	}
+	return normalizeURL(u) == normalizeURL(ru)
+}
+
+// matchRecords finds the entries made for any of the URLs or cache key names.
+func matchRecords(args []string) (found []cacheRecord) {
+	for _, rec := range cacheRecords() {
+		for _, arg := range args {
+			if rec.Matches(arg) {
+				found = append(found, rec)
+				break
+			}
+		}
+	}
+	return
+}
+
+// cacheRecords reads the metadata of every entry in the cache directory.
+func cacheRecords() (records []cacheRecord) {
+	files, err := filepath.Glob(filepath.Join(cacheDir, "jqurl_*.meta"))
+	if err != nil {
+		log.Fatalf("Error listing cache directory %q: %s", cacheDir, err)
+	}
+	for _, f := range files {
+		cacheFile := strings.TrimSuffix(f, ".meta")
+		if isHistoryFile(cacheFile) {
+			continue
+		}
+		meta, err := readCacheMeta(cacheFile)
+		if err != nil {
+			if debug {
+				log.Println(err)
+			}
+			continue
+		}
+		records = append(records, cacheRecord{File: cacheFile, cacheMeta: meta})
+	}
+	return
+}
+
+// removeRecords deletes the body and metadata of cache entries, along with
+// any history and query results kept.
+func removeRecords(records []cacheRecord) {
+	for _, rec := range records {
+		for _, f := range entryFiles(rec.File) {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Error removing %q: %s\n", f, err)
+			}
+		}
+	}
+}
+
+// printRecords writes the cache entries out as a JSON array.
+func printRecords(records []cacheRecord) {
+	if records == nil {
+		records = []cacheRecord{}
+	}
+	var out []byte
+	if pretty {
+		out, _ = json.MarshalIndent(records, "", "  ")
+	} else {
+		out, _ = json.Marshal(records)
+	}
+	fmt.Printf("%s\n", out)
+}
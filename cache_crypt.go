@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Prefix on encrypted cache bodies, followed by the nonce and ciphertext
+var encryptedMagic = []byte("JQE1")
+
+var (
+	cacheSecretKey []byte
+	cacheAEAD      cipher.AEAD
+)
+
+// cacheSecret returns the secret behind cache encryption and signing,
+// loading it on first use.  It comes from --encrypt-key, the JQURL_CACHE_KEY
+// environment variable, or else a random key kept in the user's config
+// directory.
+func cacheSecret() ([]byte, error) {
+	if cacheSecretKey != nil {
+		return cacheSecretKey, nil
+	}
+	var secret []byte
+	var err error
+	if encryptKeyFile != "" {
+		if secret, err = ioutil.ReadFile(encryptKeyFile); err != nil {
+			return nil, fmt.Errorf("Error reading encryption key %q: %s", encryptKeyFile, err)
+		}
+	} else if env := os.Getenv("JQURL_CACHE_KEY"); env != "" {
+		secret = []byte(env)
+	} else if secret, err = userCacheKey(); err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, errors.New("Empty cache encryption key")
+	}
+	cacheSecretKey = secret
+	return secret, nil
+}
+
+// cacheCipher returns the AES-GCM cipher for cache bodies.
+func cacheCipher() (cipher.AEAD, error) {
+	if cacheAEAD != nil {
+		return cacheAEAD, nil
+	}
+	secret, err := cacheSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the secret so a passphrase of any length can be used
+	sum := sha256.Sum256(secret)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	if cacheAEAD, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return cacheAEAD, nil
+}
+
+// signData computes the HMAC of data stored under a cache file name.
+func signData(cacheFile string, data []byte) (string, error) {
+	secret, err := cacheSecret()
+	if err != nil {
+		return "", err
+	}
+	// Use a different key than the one used for encryption
+	key := sha256.Sum256(append([]byte("jqurl hmac\n"), secret...))
+	mac := hmac.New(sha256.New, key[:])
+	fmt.Fprintf(mac, "%s\n", entryName(cacheFile))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// signMeta computes the HMAC of a cache entry's metadata, which includes the
+// checksum of the stored body, tied to the cache file name.
+func signMeta(cacheFile string, m *cacheMeta) (string, error) {
+	unsigned := *m
+	unsigned.MAC = ""
+	byt, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	return signData(cacheFile, byt)
+}
+
+// verifyMeta checks the HMAC on a cache entry's metadata.
+func verifyMeta(cacheFile string, m *cacheMeta) error {
+	want, err := signMeta(cacheFile, m)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(want), []byte(m.MAC)) {
+		return fmt.Errorf("Cache file %q failed HMAC verification", cacheFile)
+	}
+	return nil
+}
+
+// userCacheKey reads the per user key, creating one on first use.
+func userCacheKey() ([]byte, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find a place for the cache encryption key: %s", err)
+	}
+	dir = filepath.Join(dir, "jqurl")
+	keyFile := filepath.Join(dir, "cache.key")
+	if secret, err := ioutil.ReadFile(keyFile); err == nil {
+		return secret, nil
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, err
+	}
+	secret = []byte(fmt.Sprintf("%x\n", secret))
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		// Another jqurl may have just made one
+		return ioutil.ReadFile(keyFile)
+	}
+	defer f.Close()
+	if debug {
+		log.Println("created cache encryption key", keyFile)
+	}
+	_, err = f.Write(secret)
+	return secret, err
+}
+
+// encryptBody seals a body for the cache file, binding it to the file name
+// so entries can't be swapped around.
+func encryptBody(cacheFile string, body []byte) ([]byte, error) {
+	aead, err := cacheCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, encryptedMagic...), nonce...)
+	return aead.Seal(out, nonce, body, []byte(entryName(cacheFile))), nil
+}
+
+// decryptBody opens a body sealed by encryptBody, failing if it has been
+// tampered with.
+func decryptBody(cacheFile string, data []byte) ([]byte, error) {
+	aead, err := cacheCipher()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, encryptedMagic) || len(data) < len(encryptedMagic)+aead.NonceSize() {
+		return nil, fmt.Errorf("Cache file %q is not encrypted", cacheFile)
+	}
+	data = data[len(encryptedMagic):]
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, data, []byte(entryName(cacheFile)))
+	if err != nil {
+		return nil, fmt.Errorf("Cache file %q failed decryption: %s", cacheFile, err)
+	}
+	return body, nil
+}
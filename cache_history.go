@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xhit/go-str2duration"
+)
+
+// historyFile is where a previous body of a cache entry is kept, named by
+// when it was fetched.
+func historyFile(cacheFile string, fetched time.Time) string {
+	return fmt.Sprintf("%s.h%d", cacheFile, fetched.UnixNano())
+}
+
+// historyFiles lists the previous bodies kept for a cache entry, newest
+// first.
+func historyFiles(cacheFile string) []string {
+	metas, _ := filepath.Glob(cacheFile + ".h*.meta")
+	files := make([]string, len(metas))
+	for i, m := range metas {
+		files[i] = strings.TrimSuffix(m, ".meta")
+	}
+	// The names hold the fetch time, so sort by name
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files
+}
+
+// entryName is the name a cache file is known by for encryption and signing,
+// which stays the same as a body moves into the history.
+func entryName(file string) string {
+	base := filepath.Base(file)
+	if i := strings.Index(base, ".h"); i > 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// isHistoryFile reports if a file holds a previous version of an entry.
+func isHistoryFile(file string) bool {
+	return entryName(file) != filepath.Base(file)
+}
+
+// rotateHistory moves the current body of a cache entry into the history
+// before it is replaced, and drops the versions beyond --cache-history.
+func rotateHistory(cacheFile string) {
+	if cacheHistory <= 0 {
+		return
+	}
+	if meta, err := readCacheMeta(cacheFile); err == nil {
+		hist := historyFile(cacheFile, meta.Fetched)
+		if err = os.Rename(cacheFile, hist); err == nil {
+			err = os.Rename(metaFile(cacheFile), metaFile(hist))
+		}
+		if err != nil && debug {
+			log.Println("Error keeping cache history", err)
+		}
+	}
+	// The current body counts as one of the versions kept
+	hist := historyFiles(cacheFile)
+	for i := cacheHistory - 1; i < len(hist); i++ {
+		os.Remove(hist[i])
+		os.Remove(metaFile(hist[i]))
+	}
+}
+
+// cacheVersion is one body of an entry and when it was fetched.
+type cacheVersion struct {
+	Fetched time.Time
+	Data    interface{}
+}
+
+// cacheVersions reads the current and previous bodies of a cache entry,
+// newest first.  Versions which fail to load are skipped.
+func cacheVersions(cacheFile string) (versions []cacheVersion) {
+	for _, f := range append([]string{cacheFile}, historyFiles(cacheFile)...) {
+		meta, err := readCacheMeta(f)
+		if err != nil {
+			continue
+		}
+		var v interface{}
+		byt, err := readCacheBody(f, meta)
+		if err == nil {
+			err = json.Unmarshal(byt, &v)
+		}
+		if err != nil {
+			if debug {
+				log.Println("Cannot use cache history", f, err)
+			}
+			continue
+		}
+		versions = append(versions, cacheVersion{Fetched: meta.Fetched, Data: v})
+	}
+	return
+}
+
+// loadHistory replaces dat with the version picked by --at or --version, or
+// with every version when --history is set, from the most recently fetched
+// cache entry among the URLs.
+func loadHistory() error {
+	var cacheFile string
+	var latest time.Time
+	for _, f := range cacheFiles {
+		if meta, err := readCacheMeta(f); err == nil && meta.Fetched.After(latest) {
+			cacheFile, latest = f, meta.Fetched
+		}
+	}
+	if cacheFile == "" {
+		return fmt.Errorf("No cache entry to find the history of")
+	}
+	versions := cacheVersions(cacheFile)
+
+	switch {
+	case queryHistory:
+		// Present the versions oldest first, for trends, using the plain types
+		// the jq engine works with
+		list := make([]interface{}, len(versions))
+		for i, v := range versions {
+			list[len(versions)-1-i] = map[string]interface{}{
+				"fetched": v.Fetched.Format(time.RFC3339Nano),
+				"data":    v.Data,
+			}
+		}
+		dat = list
+	case historyAt != "":
+		at, err := parseAt(historyAt)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			if !v.Fetched.After(at) {
+				dat = v.Data
+				return nil
+			}
+		}
+		return fmt.Errorf("No cache version from before %s", at.Format(time.RFC3339))
+	default:
+		if historyVersion > 0 || -historyVersion >= len(versions) {
+			return fmt.Errorf("No cache version %d, there are %d", historyVersion, len(versions))
+		}
+		dat = versions[-historyVersion].Data
+	}
+	return nil
+}
+
+// parseAt reads a point in time given either as a timestamp or as a duration
+// into the past, such as 2h-ago, 90m or 1d.
+func parseAt(at string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return t, nil
+	}
+	at = strings.TrimSuffix(strings.TrimSuffix(at, "-ago"), " ago")
+	d, err := time.ParseDuration(at)
+	if err != nil {
+		// Which knows days and weeks, though not more than 59m
+		d, err = str2duration.Str2Duration(at)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q, expecting RFC3339 or a duration like 2h-ago", at)
+	}
+	return time.Now().Add(-d), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a lock or Vary file is left without a cache entry before it is
+// taken as orphaned
+const orphanAge = time.Hour
+
+// byteSize is a size flag which takes suffixes, such as 512K, 10M or 1G.
+type byteSize int64
+
+func (b *byteSize) Set(val []string) error {
+	s := strings.ToUpper(strings.TrimSpace(val[0]))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Invalid size %q", val[0])
+	}
+	*b = byteSize(n * float64(mult))
+	return nil
+}
+func (b *byteSize) Get() interface{} { return int64(*b) }
+func (b *byteSize) String() string   { return strconv.FormatInt(int64(*b), 10) }
+
+// evictCache removes the least recently used entries until the cache is
+// within the --cache-max-size and --cache-max-entries limits.  The entry
+// just written is always kept.
+func evictCache(keep string) {
+	if cacheMaxSize <= 0 && cacheMaxEntries <= 0 {
+		return
+	}
+	records := cacheRecords()
+	var total int64
+	sizes := make(map[string]int64)
+	for _, rec := range records {
+		var size int64
+		for _, f := range entryFiles(rec.File) {
+			if stat, err := os.Stat(f); err == nil {
+				size += stat.Size()
+			}
+		}
+		sizes[rec.File] = size
+		total += size
+	}
+
+	lastUsed := func(rec cacheRecord) int64 {
+		if rec.Accessed.IsZero() {
+			return rec.Fetched.UnixNano()
+		}
+		return rec.Accessed.UnixNano()
+	}
+	sort.Slice(records, func(i, j int) bool { return lastUsed(records[i]) < lastUsed(records[j]) })
+
+	count := len(records)
+	for _, rec := range records {
+		if (cacheMaxSize <= 0 || total <= int64(cacheMaxSize)) &&
+			(cacheMaxEntries <= 0 || count <= cacheMaxEntries) {
+			break
+		}
+		if rec.File == keep {
+			continue
+		}
+		if debug {
+			log.Println("evicting cache", rec.File, rec.URL)
+		}
+		removeRecords([]cacheRecord{rec})
+		total -= sizes[rec.File]
+		count--
+	}
+	removeOrphans()
+}
+
+// removeOrphans deletes the lock and Vary files left without a cache entry,
+// such as the lock taken for a reply which was not cached.  Recent ones are
+// kept, as they may belong to a fetch still under way, and a lock is only
+// removed once it can be taken without waiting.
+func removeOrphans() {
+	bases := make(map[string]bool)
+	for _, rec := range cacheRecords() {
+		bases[rec.File] = true
+		if rec.Base != "" {
+			bases[filepath.Join(cacheDir, filepath.Base(rec.Base))] = true
+		}
+	}
+	locks, _ := filepath.Glob(filepath.Join(cacheDir, "jqurl_*.lock"))
+	varys, _ := filepath.Glob(filepath.Join(cacheDir, "jqurl_*.vary"))
+	for _, f := range append(locks, varys...) {
+		if bases[strings.TrimSuffix(f, filepath.Ext(f))] {
+			continue
+		}
+		if st, err := os.Stat(f); err != nil || time.Since(st.ModTime()) < orphanAge {
+			continue
+		}
+		if filepath.Ext(f) == ".lock" {
+			removeLock(f)
+			continue
+		}
+		if debug {
+			log.Println("removing orphaned", f)
+		}
+		os.Remove(f)
+	}
+}
+
+// removeLock deletes a lock file unless another fetch holds it, as unlinking
+// a held lock would let the next fetch lock a new file and not wait.
+func removeLock(file string) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err = lockFileTry(f); err != nil {
+		if debug {
+			log.Println("lock in use", file, err)
+		}
+		return
+	}
+	if debug {
+		log.Println("removing orphaned", file)
+	}
+	os.Remove(file)
+}
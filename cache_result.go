@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	resultFile  string // where the query output for the cached body is kept
+	queryResult []byte // output of an earlier run of the same query
+)
+
+// resultName is the file holding the output of the query over a cached body.
+// It is keyed on the body checksum, the query and everything else which
+// changes the output.
+func resultName(cacheFile string, m *cacheMeta) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%t %t\n%s\n", entryName(cacheFile), m.Sum, raw, pretty, JQString)
+	// The output also depends on the values given to the query's variables
+	if args, err := json.Marshal(jqArgsValue()); err == nil {
+		h.Write(args)
+	}
+	// and, for queries which may look at it, on the environment
+	if strings.Contains(strings.ToLower(JQString), "env") {
+		fmt.Fprintf(h, "%q\n", jqEnviron())
+	}
+	return fmt.Sprintf("%s.r%x", cacheFile, h.Sum(nil))
+}
+
+// loadResult points resultFile at the stored output for a cached body when
+// --cache-results is set, and reads it into queryResult if there is one.
+func loadResult(cacheFile string, m *cacheMeta) bool {
+	// Queries over the history depend on more than the latest body
+	if !cacheResults || m.Sum == "" || queryHistory || historyAt != "" || historyVersion != 0 {
+		return false
+	}
+	resultFile = resultName(cacheFile, m)
+	byt, err := readCacheFile(resultFile)
+	if err != nil {
+		return false
+	}
+	if encryptCache {
+		byt, err = decryptBody(resultFile, byt)
+	} else if cacheHMAC {
+		var mac string
+		if i := bytes.IndexByte(byt, '\n'); i > 0 {
+			mac, byt = string(byt[:i]), byt[i+1:]
+		}
+		if want, err2 := signData(resultFile, byt); err2 != nil || !hmac.Equal([]byte(want), []byte(mac)) {
+			err = fmt.Errorf("Result file %q failed HMAC verification", resultFile)
+		}
+	}
+	if err != nil {
+		if debug {
+			log.Println("Cannot use cached result", err)
+		}
+		return false
+	}
+	queryResult = byt
+	return true
+}
+
+// saveResult stores the query output in resultFile, sealed the same way as
+// the cached body.
+func saveResult(out []byte) {
+	var err error
+	if encryptCache {
+		out, err = encryptBody(resultFile, out)
+	} else if cacheHMAC {
+		var mac string
+		if mac, err = signData(resultFile, out); err == nil {
+			out = append([]byte(mac+"\n"), out...)
+		}
+	}
+	if err == nil {
+		err = writeFileAtomic(resultFile, out)
+	}
+	if err != nil && debug {
+		log.Println("Error writing cached result", err)
+	}
+}
+
+// removeResults drops the stored query outputs for a cache entry, as the body
+// is being replaced.
+func removeResults(cacheFile string) {
+	files, _ := filepath.Glob(cacheFile + ".r*")
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// entryFiles lists every file belonging to a cache entry, which are the body
+// and metadata, followed by any history and query results, and the Vary
+// record named for the request.  Variants share the Vary record, so removing
+// one has the others learn it again on their next fetch.  The lock is left to
+// removeOrphans, as another fetch may be holding it.
+func entryFiles(cacheFile string) []string {
+	files := []string{cacheFile, metaFile(cacheFile)}
+	for _, hist := range historyFiles(cacheFile) {
+		files = append(files, hist, metaFile(hist))
+	}
+	results, _ := filepath.Glob(cacheFile + ".r*")
+	files = append(files, results...)
+
+	base := cacheFile
+	if meta, err := readCacheMeta(cacheFile); err == nil && meta.Base != "" {
+		base = filepath.Join(filepath.Dir(cacheFile), filepath.Base(meta.Base))
+	}
+	return append(files, base+".vary")
+}
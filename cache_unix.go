@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// lockFileWait blocks until an exclusive lock is held on the file.  The lock
+// is released when the file is closed.
+func lockFileWait(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// lockFileTry takes an exclusive lock on the file without waiting, failing
+// if another process holds it.
+func lockFileTry(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// userID names the current user for the private cache directory.
+func userID() string {
+	return strconv.Itoa(os.Getuid())
+}
+
+// checkPrivate makes sure a cache file or directory is owned by the current
+// user and can't be written by anyone else.
+func checkPrivate(file string, fi os.FileInfo) error {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("Cache file %q is owned by uid %d, not %d", file, stat.Uid, os.Getuid())
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("Cache file %q is writable by other users, mode %s", file, fi.Mode().Perm())
+	}
+	return nil
+}
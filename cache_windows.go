@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strings"
+)
+
+// lockFileWait is a no-op on windows, so requests are not coalesced there.
+func lockFileWait(f *os.File) error {
+	return nil
+}
+
+// lockFileTry always succeeds on windows, where locks are never held.
+func lockFileTry(f *os.File) error {
+	return nil
+}
+
+// userID names the current user for the private cache directory.
+func userID() string {
+	if u, err := user.Current(); err == nil {
+		return strings.NewReplacer(`\`, "_", "/", "_").Replace(u.Username)
+	}
+	return "user"
+}
+
+// checkPrivate relies on the per user temp directory on windows, as files
+// don't carry unix style ownership.
+func checkPrivate(file string, fi os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	compressedResponse, compressBody bool
+)
+
+// The encodings asked for with --compressed, all of which decodeContent reads
+const acceptEncoding = "gzip, deflate, zstd, br"
+
+// Leading bytes of a gzip or zstd file
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// readBody reads a response body, undoing any Content-Encoding and then any
+// gzip or zstd wrapping of the document itself, such as a .json.gz file.
+func readBody(resp *http.Response) ([]byte, error) {
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Encodings are listed in the order applied, so undo them from the end
+	encodings := strings.Split(resp.Header.Get("Content-Encoding"), ",")
+	for j := len(encodings) - 1; j >= 0; j-- {
+		if byt, err = decodeContent(strings.TrimSpace(encodings[j]), byt); err != nil {
+			return nil, err
+		}
+	}
+	return unwrapDocument(byt)
+}
+
+// decodeContent undoes one content coding.
+func decodeContent(encoding string, byt []byte) ([]byte, error) {
+	var rdr io.Reader
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return byt, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(byt))
+		if err != nil {
+			return nil, err
+		}
+		rdr = zr
+	case "deflate":
+		// Meant to be zlib wrapped, though some servers send it bare
+		if zr, err := zlib.NewReader(bytes.NewReader(byt)); err == nil {
+			rdr = zr
+		} else {
+			rdr = flate.NewReader(bytes.NewReader(byt))
+		}
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(byt))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		rdr = zr
+	case "br":
+		rdr = brotli.NewReader(bytes.NewReader(byt))
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding %q", encoding)
+	}
+	out, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding %s body: %s", encoding, err)
+	}
+	return out, nil
+}
+
+// unwrapDocument decompresses a JSON document served gzip or zstd compressed,
+// as is often done for large files, leaving anything else as it is.
+func unwrapDocument(byt []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(byt, gzipMagic):
+		return decodeContent("gzip", byt)
+	case bytes.HasPrefix(byt, zstdMagic):
+		return decodeContent("zstd", byt)
+	}
+	return byt, nil
+}
+
+// gzipBody compresses a request body for --compress-body.  Data given on the
+// command line is compressed up front so it can still be sent with a length,
+// while files and forms are compressed as they are streamed.
+func gzipBody(rdr io.Reader) io.Reader {
+	if sr, ok := rdr.(*strings.Reader); ok {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		sr.WriteTo(zw)
+		zw.Close()
+		return bytes.NewReader(buf.Bytes())
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, rdr)
+		if err == nil {
+			err = zw.Close()
+		}
+		if c, ok := rdr.(io.Closer); ok {
+			c.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// openRequestBody is openBody with --compress-body applied, giving the body
+// exactly as sent.
+func openRequestBody() (io.Reader, string, error) {
+	rdr, contentType, err := openBody()
+	if err == nil && rdr != nil && compressBody {
+		rdr = gzipBody(rdr)
+	}
+	return rdr, contentType, err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	cookieFile, cookieJarFile string
+	cookieJar                 *recordingJar
+)
+
+// cookieRecord is a cookie as kept in a Netscape cookies.txt file.
+type cookieRecord struct {
+	Domain     string // with a leading dot when it includes subdomains
+	Subdomains bool
+	Path       string
+	Secure     bool
+	HttpOnly   bool
+	Expires    time.Time // zero for a session cookie
+	Name       string
+	Value      string
+}
+
+// recordingJar is a cookie jar which also keeps a record of every cookie it
+// is given, as the standard jar has no way to list them for saving.
+type recordingJar struct {
+	*cookiejar.Jar
+	records map[string]*cookieRecord
+}
+
+func newRecordingJar() *recordingJar {
+	jar, _ := cookiejar.New(nil)
+	return &recordingJar{Jar: jar, records: make(map[string]*cookieRecord)}
+}
+
+// SetCookies stores the cookies from a response in the jar and the record.
+func (j *recordingJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	now := time.Now()
+	for _, c := range cookies {
+		r := &cookieRecord{Name: c.Name, Value: c.Value, Secure: c.Secure, HttpOnly: c.HttpOnly}
+		if c.Domain != "" {
+			r.Domain, r.Subdomains = "."+strings.TrimPrefix(strings.ToLower(c.Domain), "."), true
+		} else {
+			r.Domain = strings.ToLower(u.Hostname())
+		}
+		r.Path = c.Path
+		if !strings.HasPrefix(r.Path, "/") {
+			// The default path is the directory of the request path
+			r.Path = path.Dir(u.EscapedPath())
+			if !strings.HasPrefix(r.Path, "/") {
+				r.Path = "/"
+			}
+		}
+		switch {
+		case c.MaxAge < 0:
+			r.Expires = now
+		case c.MaxAge > 0:
+			r.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		default:
+			r.Expires = c.Expires
+		}
+		key := r.Domain + "\t" + r.Path + "\t" + r.Name
+		if !r.Expires.IsZero() && !r.Expires.After(now) {
+			delete(j.records, key)
+			continue
+		}
+		if !j.holds(r) {
+			// Turned down by the jar, such as a Domain the host can't set
+			if debug {
+				log.Printf("Cookie %s for %s refused from %s", r.Name, r.Domain, u.Host)
+			}
+			continue
+		}
+		j.records[key] = r
+	}
+}
+
+// holds reports if the jar took a cookie, by asking it for the cookies it
+// would send to where the cookie belongs.
+func (j *recordingJar) holds(r *cookieRecord) bool {
+	scheme := "http"
+	if r.Secure {
+		scheme = "https"
+	}
+	host := strings.TrimPrefix(r.Domain, ".")
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u := &url.URL{Scheme: scheme, Host: host, Path: r.Path}
+	for _, c := range j.Jar.Cookies(u) {
+		if c.Name == r.Name && c.Value == r.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCookies reads a Netscape cookies.txt file into the jar.  Like curl, a
+// file which does not exist yet is not an error.
+func (j *recordingJar) loadCookies(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line, httpOnly = strings.TrimPrefix(line, "#HttpOnly_"), true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			if debug {
+				fmt.Println("Skipping malformed cookie line:", line)
+			}
+			continue
+		}
+		expires, _ := strconv.ParseInt(fields[4], 10, 64)
+		c := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = host
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		j.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: c.Path}, []*http.Cookie{c})
+	}
+	return scanner.Err()
+}
+
+// saveCookies writes every cookie still good out in the Netscape format.
+func (j *recordingJar) saveCookies(file string) error {
+	records := make([]*cookieRecord, 0, len(j.records))
+	now := time.Now()
+	for _, r := range j.records {
+		if r.Expires.IsZero() || r.Expires.After(now) {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(a, b int) bool {
+		ra, rb := records[a], records[b]
+		if ra.Domain != rb.Domain {
+			return ra.Domain < rb.Domain
+		}
+		if ra.Path != rb.Path {
+			return ra.Path < rb.Path
+		}
+		return ra.Name < rb.Name
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("# Netscape HTTP Cookie File\n# Written by jqURL, edit at your own risk.\n\n")
+	tf := func(b bool) string {
+		if b {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	for _, r := range records {
+		domain := r.Domain
+		if r.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		var expires int64
+		if !r.Expires.IsZero() {
+			expires = r.Expires.Unix()
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, tf(r.Subdomains), r.Path, tf(r.Secure), expires, r.Name, r.Value)
+	}
+	// Written through a temp file only the user can read, as cookies may
+	// hold session secrets
+	return writeFileAtomic(file, buf.Bytes())
+}
+
+// setCookie handles -b, which is either a cookies.txt file to load or, when
+// it holds an =, cookies to send as they are.
+func setCookie(val []string) error {
+	if strings.Contains(val[0], "=") {
+		if c := Headers.Header.Get("Cookie"); c != "" {
+			Headers.Header.Set("Cookie", c+"; "+val[0])
+		} else {
+			Headers.Header.Set("Cookie", val[0])
+		}
+		return nil
+	}
+	cookieFile = val[0]
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pschou/go-params"
+)
+
+// go-params hands a flag wanting more than one value its values but leaves
+// them in the arguments too, where they would be read as the query and URLs.
+// So flags taking a pair, such as --arg NAME VALUE, are registered as taking
+// one value and the pair is joined into one argument before parsing.
+const flagPairSep = "\x00"
+
+// The long names of the flags registered with pairFlagFunc
+var pairFlags = make(map[string]bool)
+
+// pairFlagFunc registers a flag taking two values, handed to fn as a pair.
+func pairFlagFunc(name, usage, typeExp string, fn func([]string) error) {
+	pairFlags[name] = true
+	params.FlagFunc(name, usage, typeExp, 1, func(val []string) error {
+		pair := strings.SplitN(val[0], flagPairSep, 2)
+		if len(pair) < 2 {
+			return errors.New("Expecting two values, " + typeExp)
+		}
+		return fn(pair)
+	})
+}
+
+// joinFlagPairs joins the two values following each pair flag into one
+// argument, stepping over the values of the other flags so a value is never
+// taken for a flag.
+func joinFlagPairs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || len(a) < 2 || a[0] != '-' {
+			// The flags end at the first argument which is not one
+			return append(out, args[i:]...)
+		}
+		out = append(out, a)
+
+		if strings.HasPrefix(a, "--") {
+			name := a[2:]
+			if strings.Contains(name, "=") {
+				continue
+			}
+			if pairFlags[name] && i+2 < len(args) {
+				out = append(out, args[i+1]+flagPairSep+args[i+2])
+				i += 2
+			} else if f := params.Lookup(name); f != nil && f.ArgsNeeded == 1 && i+1 < len(args) {
+				out = append(out, args[i+1])
+				i++
+			}
+			continue
+		}
+
+		// Single dashed flags can be combined, with the last taking a value
+		// either from the rest of the argument or the next one
+		for rest := a[1:]; rest != ""; {
+			_, n := utf8.DecodeRuneInString(rest)
+			f := params.Lookup(rest[:n])
+			rest = rest[n:]
+			if f != nil && f.ArgsNeeded == 1 {
+				if rest == "" && i+1 < len(args) {
+					out = append(out, args[i+1])
+					i++
+				}
+				break
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// formField is a part of a multipart form given with -F.
+type formField struct {
+	Name        string
+	Value       string // literal value, when there is no file
+	File        string // file to upload, or to read the value from
+	Upload      bool   // send the file as an upload rather than a value
+	ContentType string
+	Filename    string
+}
+
+var (
+	formFields  []formField
+	formEncoded bool
+)
+
+// addFormField parses a curl style -F argument, one of name=value,
+// name=@file or name=<file, where a file may be followed by ;type=TYPE and
+// ;filename=NAME.
+func addFormField(val []string) error {
+	parts := strings.SplitN(val[0], "=", 2)
+	if len(parts) < 2 || parts[0] == "" {
+		return errors.New("Malformatted form field, expecting name=value")
+	}
+	f := formField{Name: parts[0], Value: parts[1]}
+	if strings.HasPrefix(f.Value, "@") || strings.HasPrefix(f.Value, "<") {
+		f.Upload = f.Value[0] == '@'
+		opts := strings.Split(f.Value[1:], ";")
+		f.File, f.Value = opts[0], ""
+		for _, opt := range opts[1:] {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) < 2 {
+				return fmt.Errorf("Malformatted form field option %q", opt)
+			}
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "type":
+				f.ContentType = kv[1]
+			case "filename":
+				f.Filename = kv[1]
+			default:
+				return fmt.Errorf("Unknown form field option %q", kv[0])
+			}
+		}
+		// Catch a missing file now rather than on every try
+		if _, err := os.Stat(f.File); err != nil {
+			return err
+		}
+	}
+	formFields = append(formFields, f)
+	return nil
+}
+
+// addURLEncoded parses a curl style --data-urlencode argument, one of
+// content, =content, name=content, @file or name@file, and adds it to the
+// request body.
+func addURLEncoded(val []string) error {
+	piece, err := urlEncodePiece(val[0])
+	if err != nil {
+		return err
+	}
+	if dataSet && !postDataRaw && strings.HasPrefix(postData, "@") {
+		return errors.New("Cannot combine --data-urlencode with a file given to --data")
+	}
+	if dataSet && postData != "" {
+		piece = postData + "&" + piece
+	}
+	postData, postDataRaw, dataSet, formEncoded = piece, true, true, true
+	return nil
+}
+
+// urlEncodePiece encodes one of content, =content, name=content, @file or
+// name@file as a name=value pair, or a bare value when there is no name.
+func urlEncodePiece(arg string) (string, error) {
+	var name, content string
+	if i := strings.IndexAny(arg, "=@"); i < 0 {
+		content = arg
+	} else if arg[i] == '=' {
+		name, content = arg[:i], arg[i+1:]
+	} else {
+		name = arg[:i]
+		byt, err := ioutil.ReadFile(arg[i+1:])
+		if err != nil {
+			return "", err
+		}
+		content = string(byt)
+	}
+	piece := url.QueryEscape(content)
+	if name != "" {
+		piece = name + "=" + piece
+	}
+	return piece, nil
+}
+
+// formBoundary is taken from the form fields rather than picked at random so
+// the same form gives the same body, and so the same cache entry.
+func formBoundary() string {
+	h := sha256.New()
+	for _, f := range formFields {
+		fmt.Fprintf(h, "%q %q %q %q %q\n", f.Name, f.Value, f.File, f.ContentType, f.Filename)
+	}
+	return fmt.Sprintf("jqurl%x", h.Sum(nil)[:15])
+}
+
+// formReader is a multipart form being streamed, with its length worked out
+// ahead of time so it can be sent without chunking.
+type formReader struct {
+	*io.PipeReader
+	length int64
+}
+
+// formBody streams the multipart form, reading files as they are sent rather
+// than holding them in memory, and returns it with its Content-Type.
+func formBody() (io.Reader, string, error) {
+	length, err := formLength()
+	if err != nil {
+		return nil, "", err
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	mw.SetBoundary(formBoundary())
+	go func() {
+		err := writeForm(mw, false)
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return &formReader{PipeReader: pr, length: length}, mw.FormDataContentType(), nil
+}
+
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// formLength adds up the size of the form, leaving out the files and then
+// adding on their sizes.
+func formLength() (int64, error) {
+	var n countWriter
+	mw := multipart.NewWriter(&n)
+	if err := mw.SetBoundary(formBoundary()); err != nil {
+		return 0, err
+	}
+	if err := writeForm(mw, true); err != nil {
+		return 0, err
+	}
+	mw.Close()
+	length := int64(n)
+	for _, f := range formFields {
+		if f.File != "" {
+			st, err := os.Stat(f.File)
+			if err != nil {
+				return 0, err
+			}
+			if !st.Mode().IsRegular() {
+				// A pipe or device has no size to go by
+				return -1, nil
+			}
+			length += st.Size()
+		}
+	}
+	return length, nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// writeForm writes out the parts of the form, with the files left empty when
+// only finding the length.
+func writeForm(mw *multipart.Writer, skipFiles bool) error {
+	for _, f := range formFields {
+		h := make(textproto.MIMEHeader)
+		disposition := fmt.Sprintf(`form-data; name="%s"`, quoteEscaper.Replace(f.Name))
+		if f.Upload {
+			filename := f.Filename
+			if filename == "" {
+				filename = filepath.Base(f.File)
+			}
+			disposition += fmt.Sprintf(`; filename="%s"`, quoteEscaper.Replace(filename))
+			if f.ContentType == "" {
+				if f.ContentType = mime.TypeByExtension(filepath.Ext(f.File)); f.ContentType == "" {
+					f.ContentType = "application/octet-stream"
+				}
+			}
+		}
+		h.Set("Content-Disposition", disposition)
+		if f.ContentType != "" {
+			h.Set("Content-Type", f.ContentType)
+		}
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if f.File == "" {
+			_, err = io.WriteString(w, f.Value)
+		} else if !skipFiles {
+			err = copyFile(w, f.File)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(w io.Writer, file string) error {
+	fh, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(w, fh)
+	return err
+}
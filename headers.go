@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	// Headers sent with every request, starting with the defaults
+	Headers = newHeaderSet(http.Header{"Content-Type": {"application/json"}})
+
+	// Headers only sent to URLs on a host, keyed by lower cased host
+	hostHeaders = make(map[string]*headerSet)
+)
+
+// headerSet is a set of request headers given on the command line, along
+// with the headers to leave out of the request.
+type headerSet struct {
+	Header      http.Header
+	Removed     map[string]bool
+	ContentType bool            // Content-Type given, so the body's is not used
+	given       map[string]bool // names given at least once, replacing any default
+}
+
+func newHeaderSet(defaults http.Header) *headerSet {
+	if defaults == nil {
+		defaults = make(http.Header)
+	}
+	return &headerSet{Header: defaults, Removed: make(map[string]bool), given: make(map[string]bool)}
+}
+
+// Parse adds a header in the curl forms.  "Name: value" adds a value, with
+// repeats adding more values, "Name;" sends the header empty, "Name:" leaves
+// the header out altogether and "@file" reads one header from each line of a
+// file.
+func (s *headerSet) Parse(line string) error {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "@") {
+		return s.parseFile(line[1:])
+	}
+
+	var name, value string
+	empty := false
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		name, value = line[:i], strings.TrimSpace(line[i+1:])
+	} else if strings.HasSuffix(line, ";") {
+		name, empty = strings.TrimSuffix(line, ";"), true
+	} else {
+		return errors.New("Malformatted header, expecting 'NAME: VALUE'")
+	}
+	name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+	if name == "" {
+		return errors.New("Malformatted header, missing the name")
+	}
+	if name == "Content-Type" {
+		s.ContentType = true
+	}
+
+	if value == "" && !empty {
+		s.Header.Del(name)
+		s.Removed[name] = true
+		return nil
+	}
+	delete(s.Removed, name)
+	if !s.given[name] {
+		// The first one given replaces the default
+		s.Header.Del(name)
+		s.given[name] = true
+	}
+	s.Header[name] = append(s.Header[name], value)
+	return nil
+}
+
+func (s *headerSet) parseFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = s.Parse(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// setHostHeader handles --host-header, giving a header only sent to one host.
+func setHostHeader(val []string) error {
+	host := strings.ToLower(val[0])
+	s, ok := hostHeaders[host]
+	if !ok {
+		s = newHeaderSet(nil)
+		hostHeaders[host] = s
+	}
+	return s.Parse(val[1])
+}
+
+// requestHeader is the headers for a request to a URL, with those for its
+// host taking the place of the ones for every request, along with the names
+// to leave out.
+func requestHeader(u *url.URL) *headerSet {
+	h := newHeaderSet(Headers.Header.Clone())
+	for name := range Headers.Removed {
+		h.Removed[name] = true
+	}
+	h.ContentType = Headers.ContentType
+	for _, host := range []string{strings.ToLower(u.Hostname()), strings.ToLower(u.Host)} {
+		s, ok := hostHeaders[host]
+		if !ok {
+			continue
+		}
+		for name, vals := range s.Header {
+			h.Header[name] = vals
+			delete(h.Removed, name)
+		}
+		for name := range s.Removed {
+			h.Header.Del(name)
+			h.Removed[name] = true
+		}
+		h.ContentType = h.ContentType || s.ContentType
+		if host == strings.ToLower(u.Hostname()) && u.Port() == "" {
+			// No need to look again at the same name
+			break
+		}
+	}
+	return h
+}
+
+type headerValue string
+
+func (h *headerValue) Set(val []string) error { return Headers.Parse(val[0]) }
+func (h *headerValue) Get() interface{}       { return "" }
+func (h *headerValue) String() string         { return "\"content-type: application/json\"" }
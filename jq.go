@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+// Variables given to every jq program, as with the jq command line
+var (
+	jqVarNames   []string
+	jqVarValues  = make(map[string]interface{})
+	jqPositional = []interface{}{}
+	jqArgs       bool
+	jqJSONArgs   bool
+	envPrefixes  []string
+)
+
+// jqProgram is a compiled jq program along with the values for its variables.
+type jqProgram struct {
+	code   *gojq.Code
+	values []interface{}
+}
+
+// Run runs the program over a value.
+func (p *jqProgram) Run(v interface{}) gojq.Iter {
+	return p.code.Run(v, p.values...)
+}
+
+// compileJQ parses and compiles a jq program with the variables from --arg
+// and friends bound, so every query jqurl runs is set up the same way.
+func compileJQ(src string) (*jqProgram, error) {
+	query, err := gojq.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{"$ARGS"}
+	values := []interface{}{jqArgsValue()}
+	for _, name := range jqVarNames {
+		names = append(names, "$"+name)
+		values = append(values, jqVarValues[name])
+	}
+	code, err := gojq.Compile(query, gojq.WithVariables(names), gojq.WithEnvironLoader(jqEnviron))
+	if err != nil {
+		return nil, err
+	}
+	return &jqProgram{code: code, values: values}, nil
+}
+
+// jqEnviron is the environment seen by $ENV and env, limited to the variables
+// starting with one of the --env-prefix values when any are given.
+func jqEnviron() []string {
+	env := os.Environ()
+	if len(envPrefixes) == 0 {
+		return env
+	}
+	var allowed []string
+	for _, kv := range env {
+		for _, prefix := range envPrefixes {
+			if strings.HasPrefix(kv, prefix) {
+				allowed = append(allowed, kv)
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+// jqArgsValue is $ARGS, holding the positional and named arguments.
+func jqArgsValue() map[string]interface{} {
+	named := make(map[string]interface{}, len(jqVarValues))
+	for k, v := range jqVarValues {
+		named[k] = v
+	}
+	return map[string]interface{}{
+		"positional": jqPositional,
+		"named":      named,
+	}
+}
+
+// setJQVar binds a variable, with a later flag replacing an earlier one of
+// the same name.
+func setJQVar(name string, v interface{}) {
+	if _, ok := jqVarValues[name]; !ok {
+		jqVarNames = append(jqVarNames, name)
+	}
+	jqVarValues[name] = v
+}
+
+// jqVarFlag returns the handler for a variable flag, which takes a name and
+// turns the other argument into the value.
+func jqVarFlag(value func(string) (interface{}, error)) func([]string) error {
+	return func(val []string) error {
+		v, err := value(val[1])
+		if err != nil {
+			return err
+		}
+		setJQVar(val[0], v)
+		return nil
+	}
+}
+
+func jqString(s string) (interface{}, error) { return s, nil }
+
+func jqJSON(s string) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, fmt.Errorf("Invalid JSON text %q: %s", s, err)
+	}
+	return v, nil
+}
+
+func jqRawFile(file string) (interface{}, error) {
+	byt, err := ioutil.ReadFile(file)
+	return string(byt), err
+}
+
+// jqSlurpFile reads every JSON value in a file into an array.
+func jqSlurpFile(file string) (interface{}, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := []interface{}{}
+	dec := json.NewDecoder(f)
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF {
+			return list, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Invalid JSON in %q: %s", file, err)
+		}
+		list = append(list, v)
+	}
+}
+
+// splitPositional takes the arguments after a -- following the URLs into
+// $ARGS.positional, as strings with --args or as JSON with --jsonargs.
+func splitPositional(args []string) ([]string, error) {
+	for i, arg := range args {
+		if arg != "--" {
+			continue
+		}
+		if !jqArgs && !jqJSONArgs {
+			return nil, errors.New("Arguments after -- need --args or --jsonargs")
+		}
+		for _, p := range args[i+1:] {
+			if jqJSONArgs {
+				v, err := jqJSON(p)
+				if err != nil {
+					return nil, err
+				}
+				jqPositional = append(jqPositional, v)
+			} else {
+				jqPositional = append(jqPositional, p)
+			}
+		}
+		return args[:i], nil
+	}
+	return args, nil
+}
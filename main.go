@@ -1,12 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,56 +14,61 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/itchyny/gojq"
 	"github.com/pschou/go-params"
 	"github.com/vishvananda/netns"
 )
 
+// Exit statuses used besides 1 for errors
+const (
+	exitStale   = 3 // every URL failed and an expired cache entry was used
+	exitNoCache = 4 // offline and there is no cache entry to answer from
+)
+
 var (
 	version = "debug"
 	debug   = false
-	Headers = map[string]string{
-		"content-type": "application/json",
-	}
 
 	JQString string
 	keypair  tls.Certificate
 
 	raw, includeHeader, certIgnore, flush, useCache, followRedirects, pretty bool
-	cert, key, ca, cacheDir, method, postData, outputFile                    string
-	maxTries                                                                 int
-	delay, maxAge, timeout                                                   time.Duration
+	encryptCache, compressCache, cacheHMAC, offline, queryHistory            bool
+	cacheResults, dataSet, postDataRaw                                       bool
+	cert, key, ca, cacheDir, method, postData, outputFile, maxAgeJQ          string
+	cacheKeyName, encryptKeyFile, historyAt                                  string
+	maxTries, cacheMaxEntries, cacheHistory, historyVersion                  int
+	cacheMaxSize                                                             byteSize
+	delay, maxAge, timeout, staleIfError                                     time.Duration
 	headerVals                                                               *headerValue
 	caCertPool                                                               *x509.CertPool
 
-	dat        map[string]interface{}
+	dat        interface{}
 	Args       []string
 	urls       [](*url.URL)
 	cacheFiles []string
+	cacheMetas []*cacheMeta
 
 	docker string
 )
 
-type headerValue string
-
-func (h *headerValue) Set(val []string) error {
-	parts := strings.SplitN(val[0], ":", 2)
-	if len(parts) < 2 {
-		return errors.New("Malformatted header")
+// setData returns the handler for the flags giving the request body, where
+// raw data is sent as is even when it starts with @.
+func setData(rawData bool) func([]string) error {
+	return func(val []string) error {
+		postData, postDataRaw, dataSet = val[0], rawData, true
+		return nil
 	}
-	Headers[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimPrefix(parts[1], " ")
-	return nil
 }
-func (h *headerValue) Get() interface{} { return "" }
-func (h *headerValue) String() string   { return "\"content-type: application/json\"" }
 
 func main() {
 	params.Default = "Default="
 	params.PresVar(&pretty, "pretty P", "Pretty print JSON with indents")
 	params.PresVar(&flush, "flush", "Force redownload, when using cache")
+	params.PresVar(&offline, "offline", "Answer only from the cache, of any age, without making requests")
 	params.PresVar(&useCache, "cache C", "Use local cache to speed up static queries")
 	params.PresVar(&debug, "debug", "Debug / verbose output")
 	params.PresVar(&raw, "raw-output r", "Raw output, no quotes for strings")
@@ -77,11 +81,52 @@ func main() {
 	}
 	params.StringVar(&cacheDir, "cachedir", temp, "Path for cache", "DIR")
 	params.StringVar(&outputFile, "output o", "", "Write output to <file> instead of stdout", "FILE")
-	params.DurationVar(&maxAge, "max-age", 4*time.Hour, "Max age for cache", "DURATION")
+	params.StringVar(&cacheKeyName, "cache-key", "", "Name the cache entry, shared by all the URLs given", "NAME")
+	params.PresVar(&encryptCache, "cache-encrypt", "Encrypt cached bodies with AES-GCM")
+	params.PresVar(&cacheHMAC, "cache-hmac", "Sign cache entries with an HMAC and only trust signed entries")
+	params.StringVar(&encryptKeyFile, "encrypt-key", "", "Key for cache encryption and signing, instead of $JQURL_CACHE_KEY or a per user key", "FILE")
+	params.PresVar(&compressCache, "cache-compress", "Compress cached bodies with gzip")
+	params.Var(&cacheMaxSize, "cache-max-size", "Evict least recently used entries beyond this total size (ie: 64M)", "SIZE", 1)
+	params.IntVar(&cacheMaxEntries, "cache-max-entries", 0, "Evict least recently used entries beyond this count", "COUNT")
+	params.PresVar(&cacheResults, "cache-results", "Cache the query output, reused while the cached body is unchanged")
+	params.IntVar(&cacheHistory, "cache-history", 0, "Keep this many of the latest bodies for each cache entry", "COUNT")
+	params.StringVar(&historyAt, "at", "", "Query the cached body as of a time (ie: 2h-ago or 2024-01-02T15:04:05Z)", "TIME")
+	params.IntVar(&historyVersion, "version", 0, "Query a previous cached body (ie: -1 for the one before the latest)", "N")
+	params.PresVar(&queryHistory, "history", "Query every cached body kept, oldest first, as an array of {fetched, data}")
+	params.DurationVar(&maxAge, "max-age", 4*time.Hour, "Max age for cache, when the server sends no Cache-Control or Expires", "DURATION")
+	params.DurationVar(&staleIfError, "stale-if-error", 0, "Use an expired cache entry, up to this long past expiry, when every URL fails", "DURATION")
+	params.StringVar(&maxAgeJQ, "max-age-jq", "", "JQ query on the body giving the cache max age in seconds (ie: .expires_in)", "EXPR")
 	params.GroupingSet("Request")
-	params.StringVar(&postData, "data d", "", "Data to use in POST (use @filename to read from file)", "STRING")
-	params.Var(headerVals, "header H", "Custom header to pass to server\n", "'HEADER: VALUE'", 1)
+	params.FlagFunc("cookie b", "Cookies to send, as 'NAME=VALUE; ...' or a Netscape cookies.txt file to read", "DATA|FILE", 1, setCookie)
+	params.PresVar(&compressBody, "compress-body", "Gzip the request body, sent with Content-Encoding: gzip")
+	params.PresVar(&compressedResponse, "compressed", "Ask for a compressed response with gzip, deflate, zstd or br")
+	params.StringVar(&cookieJarFile, "cookie-jar c", "", "Write the cookies to a Netscape cookies.txt file after the requests", "FILE")
+	params.FlagFunc("data d", "Data to send as the request body, POST unless -X is given (use @filename to read from file)", "STRING", 1, setData(false))
+	params.FlagFunc("data-binary", "Same as --data, sending a @filename exactly as stored", "STRING", 1, setData(false))
+	params.FlagFunc("data-raw", "Data to send as the request body, with no special meaning for @", "STRING", 1, setData(true))
+	params.FlagFunc("data-urlencode", "URL encode and add to a form body (ie: name=value, name@file)", "DATA", 1, addURLEncoded)
+	params.StringVar(&bodyJQ, "body-jq", "", "JQ expression building a JSON request body, given any body items as input", "EXPR")
+	params.FlagFunc("url-query", "URL encode and add to the query string of every URL (ie: name=value, name@file)", "DATA", 1, addURLQuery)
+	params.FlagFunc("form F", "Add a multipart form field (ie: name=value, name=@file;type=TYPE;filename=NAME)", "NAME=CONTENT", 1, addFormField)
+	params.Var(headerVals, "header H", "Custom header to pass to server, repeat to send more values, 'HEADER:' to leave one out,\n'HEADER;' to send it empty or @file for one header per line", "'HEADER: VALUE'", 1)
+	pairFlagFunc("host-header", "Custom header only passed to URLs on this host", "HOST 'HEADER: VALUE'", setHostHeader)
+	params.PresVar(&getMode, "get G", "Send the --data in the URL query string with a GET")
 	params.PresVar(&followRedirects, "location L", "Follow redirects")
+	params.StringVar(&userAuth, "user u", "", "Credentials for Basic or Digest auth, the password comes from .netrc when left off", "USER[:PASSWORD]")
+	params.PresVar(&basicAuth, "basic", "Send the credentials with Basic auth without waiting to be asked")
+	params.PresVar(&digestOnly, "digest", "Only send the credentials to answer a Digest challenge")
+	params.PresVar(&useNetrc, "netrc n", "Take credentials for each host from ~/.netrc")
+	params.StringVar(&awsSigV4, "aws-sigv4", "", "Sign requests with AWS Signature Version 4, keys from -u, the environment, ~/.aws/credentials or IMDS", "PROVIDER:REGION:SERVICE")
+	params.StringVar(&oauthTokenURL, "oauth2-token-url", "", "Get a Bearer token from this OAuth2 token endpoint, cached until it expires", "URL")
+	params.StringVar(&oauthClientID, "oauth2-client-id", "", "Client id for the OAuth2 client credentials grant", "ID")
+	params.StringVar(&oauthClientSecret, "oauth2-client-secret", "", "Client secret, or @file to read it from, else $JQURL_OAUTH2_CLIENT_SECRET", "SECRET")
+	params.StringVar(&oauthRefreshToken, "oauth2-refresh-token", "", "Get tokens with this refresh token rather than the client credentials", "TOKEN")
+	params.FlagFunc("oauth2-scope", "Scope to request with the OAuth2 token, can be repeated", "SCOPE", 1, func(val []string) error {
+		oauthScopes = append(oauthScopes, strings.Fields(val[0])...)
+		return nil
+	})
+	params.StringVar(&oauthAudience, "oauth2-audience", "", "Audience to request with the OAuth2 token", "AUDIENCE")
+	params.StringVar(&netrcFile, "netrc-file", "", "Take credentials for each host from this netrc file", "FILE")
 	params.DurationVar(&delay, "retry-delay", 7*time.Second, "Delay between retries", "DURATION")
 	params.DurationVar(&timeout, "max-time m", 15*time.Second, "Timeout per request", "DURATION")
 	params.IntVar(&maxTries, "max-tries", 30, "Maximum number of tries", "TRIES")
@@ -89,9 +134,23 @@ func main() {
 	params.StringVar(&method, "request X", "GET", "Method to use for HTTP request (ie: POST/GET)", "METHOD")
 	params.StringVar(&docker, "docker", "", "Switch to the network of a container", "CONTAINER_ID")
 
+	params.GroupingSet("Query")
+	pairFlagFunc("arg", "Set $NAME to a string in the jq queries", "NAME VALUE", jqVarFlag(jqString))
+	pairFlagFunc("argjson", "Set $NAME to a JSON value in the jq queries", "NAME JSON", jqVarFlag(jqJSON))
+	pairFlagFunc("slurpfile", "Set $NAME to an array of the JSON values in a file", "NAME FILE", jqVarFlag(jqSlurpFile))
+	pairFlagFunc("rawfile", "Set $NAME to the contents of a file as a string", "NAME FILE", jqVarFlag(jqRawFile))
+	params.FlagFunc("env-prefix", "Only give $ENV the environment variables starting with this, can be repeated", "PREFIX", 1, func(val []string) error {
+		envPrefixes = append(envPrefixes, val[0])
+		return nil
+	})
+	params.PresVar(&jqArgs, "args", "Arguments after a -- following the URLs go in $ARGS.positional as strings")
+	params.PresVar(&jqJSONArgs, "jsonargs", "Arguments after a -- following the URLs go in $ARGS.positional as JSON")
+
 	params.Usage = func() {
 		fmt.Println("jqURL - URL and JSON parser tool, Written by Paul Schou (github.com/pschou/jqURL), Version: " + version)
-		fmt.Printf("Usage:\n  %s [options] \"JSON Parser\" URLs\n\n", os.Args[0])
+		fmt.Printf("Usage:\n  %s [options] \"JSON Parser\" URLs [name=value name:=json ...] [-- ARGS]\n", os.Args[0])
+		fmt.Printf("  %s [options] cache list|show URL|rm URL|prune [--older-than DURATION]|purge\n", os.Args[0])
+		fmt.Printf("  %s [options] cache export FILE [URLs]|import FILE\n\n", os.Args[0])
 		params.PrintDefaults()
 	}
 
@@ -101,7 +160,7 @@ func main() {
 	params.StringVar(&key, "key", "", "Key file for client cert, PEM encoded", "FILE")
 
 	params.CommandLine.Indent = 2
-	params.Parse()
+	params.CommandLine.Parse(joinFlagPairs(os.Args[1:]))
 	Args = params.Args()
 
 	if ca != "" {
@@ -125,6 +184,24 @@ func main() {
 		}
 	}
 
+	isCacheCommand := len(Args) > 0 && Args[0] == "cache"
+	if offline {
+		useCache = true
+	}
+	// OAuth2 tokens are kept in the cache directory too
+	if useCache || isCacheCommand || oauthTokenURL != "" {
+		dir, err := privateCacheDir(cacheDir)
+		if err != nil {
+			log.Fatalf("Error preparing cache directory: %s", err)
+		}
+		cacheDir = dir
+	}
+
+	if isCacheCommand {
+		cacheCommand(Args[1:])
+		return
+	}
+
 	if len(Args) < 2 {
 		params.Usage()
 		os.Exit(1)
@@ -132,8 +209,23 @@ func main() {
 	}
 
 	JQString = Args[0]
-	Args = Args[1:]
+	var err error
+	if Args, err = splitPositional(Args[1:]); err != nil {
+		log.Fatalf("Error reading jq arguments: %s", err)
+	}
+	Args = splitBodyItems(Args)
+	if len(Args) == 0 {
+		params.Usage()
+		os.Exit(1)
+		return
+	}
+	if basicAuth && digestOnly {
+		log.Fatalf("Cannot use both --basic and --digest")
+	}
+	prepareBody()
+
 	cacheFiles = make([]string, len(Args))
+	cacheMetas = make([]*cacheMeta, len(Args))
 	urls = make([](*url.URL), len(Args))
 
 	for i, Arg := range Args {
@@ -142,32 +234,29 @@ func main() {
 			fmt.Println("Malformed URL:", err)
 			os.Exit(1)
 		}
+		addQuery(u)
 		urls[i] = u
 	}
 
-	for i, Arg := range Args {
-		h := sha1.New()
-		h.Write([]byte(Arg))
-		h.Write([]byte(fmt.Sprintf("%d", os.Getuid())))
-		bs := h.Sum(nil)
-
-		cacheFile := fmt.Sprintf("%s/jqurl_%x", cacheDir, bs)
-		cacheFiles[i] = cacheFile
-
-		stat, err := os.Stat(cacheFile)
-		if err == nil && !flush && useCache && time.Now().Add(maxAge).After(stat.ModTime()) {
-			if debug {
-				log.Println("found cache", cacheFile)
+	if useCache {
+		for i := range Args {
+			cacheFiles[i] = cacheFile(urls[i])
+		}
+	}
+	if offline {
+		found := false
+		for i := range Args {
+			if found = loadCache(i, true); found {
+				break
 			}
-			byt, err := ioutil.ReadFile(cacheFile)
-			if err == nil {
-				if debug {
-					log.Println("using cache", cacheFile)
-				}
-				if includeHeader {
-					fmt.Fprintf(os.Stderr, "Header skipped as cache used\nURL: %s\nFile: %s\n", urls[i], cacheFile)
-				}
-				json.Unmarshal(byt, &dat)
+		}
+		if !found {
+			fmt.Fprintln(os.Stderr, "No cache entry to use while offline")
+			os.Exit(exitNoCache)
+		}
+	} else if useCache && !flush {
+		for i := range Args {
+			if loadCache(i, false) {
 				break
 			}
 		}
@@ -194,6 +283,77 @@ func main() {
 	doCurl()
 }
 
+// prepareBody checks the ways of giving a request body fit together and sets
+// up the method and Content-Type to go with it.
+func prepareBody() {
+	if dataSet && len(formFields) > 0 {
+		log.Fatalf("Cannot send both data and a multipart form")
+	}
+	if err := buildBody(); err != nil {
+		log.Fatalf("Error building request body: %s", err)
+	}
+	if getMode {
+		if err := moveDataToQuery(); err != nil {
+			log.Fatalf("Error moving data to the query string: %s", err)
+		}
+	}
+	if err := bufferPipedBody(); err != nil {
+		log.Fatalf("Error reading request body: %s", err)
+	}
+	if formEncoded && !Headers.ContentType {
+		Headers.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if dataSet || len(formFields) > 0 {
+		// Like curl, sending data without a method given implies POST
+		request := params.Lookup("request")
+		methodSet := false
+		params.Visit(func(f *params.Flag) {
+			if f == request {
+				methodSet = true
+			}
+		})
+		if !methodSet {
+			method = "POST"
+		}
+	}
+}
+
+// bufferPipedBody reads a --data @file which is not a regular file, such as
+// /dev/stdin, into memory.  A pipe can only be read once, while the body is
+// opened again for each try and for the cache key.
+func bufferPipedBody() error {
+	if !dataSet || postDataRaw || !strings.HasPrefix(postData, "@") {
+		return nil
+	}
+	st, err := os.Stat(postData[1:])
+	if err != nil || st.Mode().IsRegular() {
+		return err
+	}
+	byt, err := ioutil.ReadFile(postData[1:])
+	if err != nil {
+		return err
+	}
+	postData, postDataRaw = string(byt), true
+	return nil
+}
+
+// openBody returns the request body to send, or nil when there is none, along
+// with the Content-Type it needs, if any.  A file or form is returned open and
+// is closed by the http client once sent.
+func openBody() (io.Reader, string, error) {
+	if len(formFields) > 0 {
+		return formBody()
+	}
+	if !dataSet {
+		return nil, "", nil
+	}
+	if !postDataRaw && len(postData) > 0 && postData[0] == '@' {
+		f, err := os.Open(postData[1:])
+		return f, "", err
+	}
+	return strings.NewReader(postData), "", nil
+}
+
 func doCurl() {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
 		InsecureSkipVerify: certIgnore,
@@ -211,92 +371,75 @@ func doCurl() {
 			return nil
 		},
 	}
-
-	for j := 0; j < maxTries && len(dat) == 0; j++ {
-		i := j % len(Args)
-		if debug {
-			log.Println("HTTP", method, urls[i])
-		}
-		var err error
-		var resp *http.Response
-		var req *http.Request
-
-		var rdr io.Reader
-		if method == "POST" {
-			if len(postData) > 0 && postData[0] == '@' {
-				f, err := os.Open(postData[1:])
-				if err != nil {
-					log.Fatalf("Unable to open %q, err: %s", postData[1:], err)
-				}
-				defer f.Close()
-				rdr = f
-			} else {
-				rdr = strings.NewReader(postData)
+	if cookieFile != "" || cookieJarFile != "" {
+		cookieJar = newRecordingJar()
+		if cookieFile != "" {
+			if err := cookieJar.loadCookies(cookieFile); err != nil {
+				log.Fatalf("Error reading cookie file %q: %s", cookieFile, err)
 			}
 		}
+		client.Jar = cookieJar
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-
-		req, err = http.NewRequestWithContext(ctx, method, urls[i].String(), rdr)
-		if err != nil {
-			log.Fatalf("New request error: %s", err)
-		}
-		if method == "POST" {
-			req.Header.Set("Content-Type", "x-www-form-urlencoded")
+	for j := 0; j < maxTries && dat == nil && queryResult == nil && !offline; j++ {
+		i := j % len(Args)
+		if fetch(client, i) {
+			break
 		}
-		for key, val := range Headers {
-			if debug {
-				fmt.Printf("Request Header: %s: %s\n", key, val)
-			}
-			req.Header.Set(key, val)
+
+		if i%len(Args) == len(Args)-1 {
+			time.Sleep(delay)
 		}
-		resp, err = client.Do(req)
-		if debug && err != nil {
-			fmt.Printf("Error doing http request: %s\n", err)
+	}
+
+	if cookieJarFile != "" {
+		if err := cookieJar.saveCookies(cookieJarFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing cookie jar %q: %s\n", cookieJarFile, err)
 		}
+	}
 
-		if err == nil {
-			if includeHeader {
-				fmt.Fprintf(os.Stderr, "%s %s\n", resp.Proto, resp.Status)
-				for key, vals := range resp.Header {
-					for _, val := range vals {
-						fmt.Fprintf(os.Stderr, "%s: %s\n", key, val)
-					}
-				}
-				fmt.Fprintf(os.Stderr, "\n")
-			}
+	stale := false
+	if dat == nil && queryResult == nil && useCache && staleIfError > 0 {
+		stale = loadStaleCache()
+	}
 
-			byt, err := ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
+	if useCache && (queryHistory || historyAt != "" || historyVersion != 0) {
+		if err := loadHistory(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-			if err == nil {
-				err = json.Unmarshal(byt, &dat)
-				if err != nil && debug {
-					log.Fatalf("Cannot unmarshall url %q err: %s", urls[i], err)
-				}
-				if err == nil {
-					if !useCache {
-						break
-					}
-					if debug {
-						log.Println("writing out file")
-					}
-					err = ioutil.WriteFile(cacheFiles[i], byt, 0666)
-					if err != nil && debug {
-						log.Fatalf("Error writing file: %s", err)
-					}
-					break
-				}
-			}
+	output := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			log.Fatalf("Error creating output file: %s", err)
 		}
+		defer f.Close()
+		output = f
+	}
 
-		if i%len(Args) == len(Args)-1 {
-			time.Sleep(delay)
+	if queryResult != nil {
+		if debug {
+			log.Println("using cached result", resultFile)
 		}
+		output.Write(queryResult)
+	} else if resultFile != "" {
+		var result bytes.Buffer
+		runQuery(io.MultiWriter(output, &result))
+		saveResult(result.Bytes())
+	} else {
+		runQuery(output)
 	}
 
-	query, err := gojq.Parse(JQString)
+	if stale {
+		os.Exit(exitStale)
+	}
+}
+
+// runQuery runs the jq query over dat and writes out the results.
+func runQuery(output io.Writer) {
+	query, err := compileJQ(JQString)
 	if err != nil {
 		log.Fatalf("Error compiling jq query %q: %s", JQString, err)
 	}
@@ -313,16 +456,6 @@ func doCurl() {
 			fmt.Printf("%#v\n", v)
 		}
 
-		output := os.Stdout
-		if outputFile != "" {
-			f, err := os.Create(outputFile)
-			if err != nil {
-				log.Fatalf("Error creating output file: %s", err)
-			}
-			defer f.Close()
-			output = f
-		}
-
 		if raw {
 			fmt.Fprintf(output, "%v\n", v)
 		} else {
@@ -336,3 +469,238 @@ func doCurl() {
 		}
 	}
 }
+
+// printHeader writes a response status line and headers to stderr.
+func printHeader(proto, status string, h http.Header) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", proto, status)
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, val := range h[key] {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", key, val)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+// fetch makes one attempt at downloading the i-th URL into dat, updating the
+// cache when in use.
+func fetch(client *http.Client, i int) bool {
+	if useCache {
+		unlock := lockCache(urls[i])
+		defer unlock()
+
+		// Another jqurl may have fetched this while we waited on the lock
+		if !flush && loadCache(i, false) {
+			return true
+		}
+	}
+
+	if debug {
+		log.Println("HTTP", method, urls[i])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if oauthTokenURL != "" && oauthAccessToken == "" {
+		if err := loadOAuthToken(client, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting OAuth2 token: %s\n", err)
+			return false
+		}
+	}
+
+	newReq := func() *http.Request { return newRequest(ctx, i) }
+	resp, err := client.Do(newReq())
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		if oauthTokenURL != "" {
+			resp, err = oauthRetry(client, resp, newReq)
+		} else if awsSigV4 == "" {
+			// Not when signing, as -u then holds the AWS secret key
+			resp, err = authRetry(client, resp, urls[i], newReq)
+		}
+	}
+	if debug && err != nil {
+		fmt.Printf("Error doing http request: %s\n", err)
+	}
+
+	if err == nil && useCache && staleIfError > 0 &&
+		(resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests) {
+		// With a stale entry to fall back on, a server error is a failed try
+		// even with a JSON body, so the next URL or the stale entry is used
+		if debug {
+			log.Printf("HTTP %s from %s", resp.Status, urls[i])
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return false
+	}
+	if err == nil {
+		revalidated := resp.StatusCode == http.StatusNotModified && cacheMetas[i] != nil
+		if includeHeader && !revalidated {
+			h := resp.Header
+			if useCache {
+				h = h.Clone()
+				h.Set("X-Cache", "MISS")
+			}
+			printHeader(resp.Proto, resp.Status, h)
+		}
+
+		byt, err := readBody(resp)
+		resp.Body.Close()
+
+		if err == nil && revalidated {
+			// The stale entry is still good, so refresh it in place
+			byt, err = readCacheBody(cacheFiles[i], cacheMetas[i])
+			if err == nil {
+				err = json.Unmarshal(byt, &dat)
+			}
+			if err == nil {
+				if debug {
+					log.Println("revalidated cache", cacheFiles[i])
+				}
+				meta := cacheMetas[i]
+				if meta.Update(resp) {
+					if maxAgeJQ != "" {
+						meta.SetMaxAgeFromJQ(dat)
+					}
+					err = writeCacheMeta(cacheFiles[i], meta)
+					if err != nil && debug {
+						log.Fatalf("Error writing file: %s", err)
+					}
+				}
+				loadResult(cacheFiles[i], meta)
+				if includeHeader {
+					meta.PrintHeader("REVALIDATED")
+				}
+				return true
+			}
+			if debug {
+				log.Println("Cannot use revalidated cache", cacheFiles[i], err)
+			}
+			// Drop the broken entry so the next try does a full download
+			cacheMetas[i] = nil
+		} else if err == nil {
+			err = json.Unmarshal(byt, &dat)
+			if err != nil && debug {
+				log.Fatalf("Cannot unmarshall url %q err: %s", urls[i], err)
+			}
+			if err == nil {
+				if !useCache {
+					return true
+				}
+				if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+					// Answer with an error reply, but keep it out of the cache
+					if debug {
+						log.Println("not caching, status", resp.Status)
+					}
+					return true
+				}
+				meta := newCacheMeta(urls[i])
+				if !meta.Update(resp) {
+					if debug {
+						log.Println("not caching, no-store requested")
+					}
+					return true
+				}
+				if maxAgeJQ != "" {
+					meta.SetMaxAgeFromJQ(dat)
+				}
+				if !setVary(urls[i], resp) {
+					if debug {
+						log.Println("not caching, response varies on everything")
+					}
+					return true
+				}
+				cacheFiles[i] = cacheFile(urls[i])
+				if debug {
+					log.Println("writing out file", cacheFiles[i])
+				}
+				err = writeCache(cacheFiles[i], byt, meta)
+				if err != nil && debug {
+					log.Fatalf("Error writing file: %s", err)
+				}
+				if err == nil {
+					loadResult(cacheFiles[i], meta)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newRequest builds the request for a URL, opening the body afresh so it
+// can be sent again, such as to answer an auth challenge.
+func newRequest(ctx context.Context, i int) *http.Request {
+	rdr, contentType, err := openRequestBody()
+	if err != nil {
+		log.Fatalf("Unable to open request body, err: %s", err)
+	}
+	var payload []byte
+	if awsSigV4 != "" && rdr != nil {
+		// The signature covers the payload, so hash the very bytes sent
+		payload, err = ioutil.ReadAll(rdr)
+		if c, ok := rdr.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			log.Fatalf("Unable to read request body, err: %s", err)
+		}
+		rdr = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urls[i].String(), rdr)
+	if err != nil {
+		log.Fatalf("New request error: %s", err)
+	}
+	// Send files and forms with their length rather than chunked
+	switch r := rdr.(type) {
+	case *os.File:
+		if st, err := r.Stat(); err == nil && st.Mode().IsRegular() {
+			req.ContentLength = st.Size()
+		}
+	case *formReader:
+		if r.length >= 0 {
+			req.ContentLength = r.length
+		}
+	}
+	header := requestHeader(urls[i])
+	for key, vals := range header.Header {
+		if debug {
+			fmt.Printf("Request Header: %s: %s\n", key, strings.Join(vals, ", "))
+		}
+		req.Header[key] = vals
+	}
+	if header.Removed["User-Agent"] {
+		// Go only leaves out its own User-Agent when it is set empty
+		req.Header.Set("User-Agent", "")
+	}
+	if contentType != "" && !header.ContentType {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if compressBody && rdr != nil {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if compressedResponse && req.Header.Get("Accept-Encoding") == "" && !header.Removed["Accept-Encoding"] {
+		// Asking for an encoding stops Go from decoding gzip itself, so the
+		// body is decoded by readBody
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if useCache && cacheMetas[i] != nil && cacheMetas[i].CanRevalidate() {
+		cacheMetas[i].SetValidators(req)
+	}
+	if awsSigV4 != "" {
+		if err := signSigV4(req, payload); err != nil {
+			log.Fatalf("Unable to sign request: %s", err)
+		}
+	} else if req.Header.Get("Authorization") == "" {
+		if oauthAccessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+oauthAccessToken)
+		} else if login, password, ok := authFor(urls[i]); ok && basicAuth {
+			req.SetBasicAuth(login, password)
+		}
+	}
+	return req
+}
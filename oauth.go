@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	oauthTokenURL, oauthClientID, oauthClientSecret string
+	oauthRefreshToken, oauthAudience                string
+	oauthScopes                                     []string
+
+	// The access token sent as a Bearer token with each request
+	oauthAccessToken string
+)
+
+// oauthTokenResponse is the reply from a token endpoint, per RFC 6749.
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// oauthCacheFile is where the token for the endpoint, client, scopes and
+// audience is kept.
+func oauthCacheFile() string {
+	h := sha1.New()
+	fmt.Fprintf(h, "oauth2\n%s\n", oauthIdentity())
+	return fmt.Sprintf("%s/jqurl_%x", cacheDir, h.Sum(nil))
+}
+
+// oauthIdentity tells apart who tokens are given to, by the endpoint, client,
+// scopes and audience, along with a hash of the secrets so they are not kept
+// in the clear.
+func oauthIdentity() string {
+	secret, _ := clientSecret()
+	secrets := sha256.Sum256([]byte(oauthRefreshToken + "\n" + secret))
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%x", oauthTokenURL, oauthClientID,
+		strings.Join(oauthScopes, " "), oauthAudience, secrets)
+}
+
+// clientSecret is the --oauth2-client-secret, read from a file when given as
+// @file, or else $JQURL_OAUTH2_CLIENT_SECRET.
+func clientSecret() (string, error) {
+	secret := oauthClientSecret
+	if secret == "" {
+		secret = os.Getenv("JQURL_OAUTH2_CLIENT_SECRET")
+	}
+	if strings.HasPrefix(secret, "@") {
+		byt, err := ioutil.ReadFile(secret[1:])
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(byt))
+	}
+	return secret, nil
+}
+
+// loadOAuthToken sets the access token, from the cache while it is good or
+// else from the token endpoint.  A token the server has turned down is not
+// used again, though its refresh token may be.
+func loadOAuthToken(client *http.Client, rejected string) error {
+	cacheFile := oauthCacheFile()
+	unlock := lockFile(cacheFile + ".lock")
+	defer unlock()
+
+	// Another jqurl may have renewed it while we waited on the lock
+	cached := readOAuthToken(cacheFile)
+	if cached != nil && cached.AccessToken != rejected {
+		if meta, err := readCacheMeta(cacheFile); err == nil && meta.Fresh() {
+			oauthAccessToken = cached.AccessToken
+			return nil
+		}
+	}
+
+	// Prefer a refresh token, the one given before any cached one, falling
+	// back on the client credentials
+	var refreshTokens []string
+	if oauthRefreshToken != "" {
+		refreshTokens = append(refreshTokens, oauthRefreshToken)
+	}
+	if cached != nil && cached.RefreshToken != "" && cached.RefreshToken != oauthRefreshToken {
+		// A server may have rotated the given one for this
+		refreshTokens = append(refreshTokens, cached.RefreshToken)
+	}
+	var tok *oauthTokenResponse
+	var err error
+	for _, refresh := range refreshTokens {
+		tok, err = requestToken(client, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refresh},
+		})
+		if err != nil {
+			if debug {
+				log.Println("Unable to refresh token:", err)
+			}
+			continue
+		}
+		if tok.RefreshToken == "" {
+			// The refresh token stays good unless a new one is given
+			tok.RefreshToken = refresh
+		}
+		break
+	}
+	if tok == nil && oauthClientID != "" {
+		tok, err = requestToken(client, url.Values{"grant_type": {"client_credentials"}})
+	}
+	if tok == nil {
+		if err == nil {
+			err = errors.New("No refresh token or client id to request a token with")
+		}
+		return err
+	}
+	oauthAccessToken = tok.AccessToken
+	if err := writeOAuthToken(cacheFile, tok); err != nil && debug {
+		log.Println("Unable to cache token:", err)
+	}
+	return nil
+}
+
+// requestToken makes a grant request to the token endpoint.
+func requestToken(client *http.Client, form url.Values) (*oauthTokenResponse, error) {
+	if len(oauthScopes) > 0 {
+		form.Set("scope", strings.Join(oauthScopes, " "))
+	}
+	if oauthAudience != "" {
+		form.Set("audience", oauthAudience)
+	}
+	secret, err := clientSecret()
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" && oauthClientID != "" {
+		// A public client only identifies itself
+		form.Set("client_id", oauthClientID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", oauthTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if secret != "" {
+		req.SetBasicAuth(url.QueryEscape(oauthClientID), url.QueryEscape(secret))
+	}
+	if debug {
+		log.Println("Requesting token", form.Get("grant_type"), oauthTokenURL)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(byt)))
+	}
+	var tok oauthTokenResponse
+	if err = json.Unmarshal(byt, &tok); err != nil {
+		return nil, fmt.Errorf("Invalid token response: %s", err)
+	}
+	if tok.AccessToken == "" {
+		return nil, errors.New("Token response has no access_token")
+	}
+	return &tok, nil
+}
+
+// readOAuthToken reads the cached token response, of any age, or nil if
+// there is none.
+func readOAuthToken(cacheFile string) *oauthTokenResponse {
+	meta, err := readCacheMeta(cacheFile)
+	if err != nil {
+		return nil
+	}
+	byt, err := readCacheBody(cacheFile, meta)
+	if err != nil {
+		if debug {
+			log.Println("Cannot use cached token", err)
+		}
+		return nil
+	}
+	var tok oauthTokenResponse
+	if err = json.Unmarshal(byt, &tok); err != nil {
+		return nil
+	}
+	return &tok
+}
+
+// writeOAuthToken caches a token response until a little before it expires.
+// Tokens are secrets, so they are always stored encrypted.
+func writeOAuthToken(cacheFile string, tok *oauthTokenResponse) error {
+	body, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(oauthTokenURL)
+	m := &cacheMeta{URL: u.String(), Method: "POST", Key: "oauth2:" + oauthClientID, Status: http.StatusOK}
+	m.Fetched = time.Now()
+	m.Accessed = m.Fetched
+	m.Expires = m.Fetched.Add(maxAge)
+	if tok.ExpiresIn > 0 {
+		// Leave some of its life for requests to reach the server
+		life := time.Duration(tok.ExpiresIn) * time.Second
+		m.Expires = m.Fetched.Add(life - life/10)
+	}
+	m.Size = len(body)
+	m.Encrypted = true
+	if body, err = encryptBody(cacheFile, body); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	m.Sum = hex.EncodeToString(sum[:])
+	if err = writeFileAtomic(cacheFile, body); err != nil {
+		return err
+	}
+	return writeCacheMeta(cacheFile, m)
+}
+
+// oauthRetry gets a new token after a 401 response and makes the request
+// again with it.  The original response is returned when no new token can
+// be had.
+func oauthRetry(client *http.Client, resp *http.Response, newReq func() *http.Request) (*http.Response, error) {
+	old := oauthAccessToken
+	if err := loadOAuthToken(client, old); err != nil || oauthAccessToken == old {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error renewing OAuth2 token: %s\n", err)
+		}
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return client.Do(newReq())
+}
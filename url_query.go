@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+var (
+	// Encoded name=value pairs added to the query string of every URL
+	urlQuery []string
+	getMode  bool
+)
+
+// addURLQuery handles --url-query, taking the same forms as --data-urlencode.
+func addURLQuery(val []string) error {
+	piece, err := urlEncodePiece(val[0])
+	if err != nil {
+		return err
+	}
+	urlQuery = append(urlQuery, piece)
+	return nil
+}
+
+// moveDataToQuery handles -G, sending the --data in the query string rather
+// than as the request body.
+func moveDataToQuery() error {
+	if len(formFields) > 0 {
+		return errors.New("Cannot send a multipart form with -G")
+	}
+	if !dataSet {
+		return nil
+	}
+	data := postData
+	if !postDataRaw && strings.HasPrefix(data, "@") {
+		byt, err := ioutil.ReadFile(data[1:])
+		if err != nil {
+			return err
+		}
+		// Like curl, line breaks in a data file are left out
+		data = strings.NewReplacer("\r", "", "\n", "").Replace(string(byt))
+	}
+	if data != "" {
+		urlQuery = append(urlQuery, data)
+	}
+	postData, postDataRaw, dataSet, formEncoded = "", false, false, false
+	return nil
+}
+
+// addQuery appends the --url-query and -G parameters to a URL, so every
+// mirror is sent the same ones.
+func addQuery(u *url.URL) {
+	if len(urlQuery) == 0 {
+		return
+	}
+	query := strings.Join(urlQuery, "&")
+	if u.RawQuery != "" {
+		query = u.RawQuery + "&" + query
+	}
+	u.RawQuery = query
+	u.ForceQuery = false
+}